@@ -0,0 +1,173 @@
+package main
+
+import "fmt"
+import "path/filepath"
+import "strings"
+
+// What a user may do, as lists of the subtrees (relative to the root of the
+// share they connect to) where they may do it. A nil list allows it anywhere.
+type Access struct {
+	Read []string
+	Write []string
+	Delete []string
+}
+
+// Whether path lies within one of the subtrees, or anywhere if the list is
+// nil. Access to a nil *Access is never restricted.
+func allowed(subtrees []string, path string) bool {
+	if subtrees == nil {
+		return true
+	}
+
+	path = filepath.Clean(path)
+	for _, subtree := range(subtrees) {
+		if subtree == "." || path == subtree ||
+			strings.HasPrefix(path, subtree + string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (access *Access) canRead(path string) bool {
+	return access == nil || allowed(access.Read, path)
+}
+
+func (access *Access) canWrite(path string) bool {
+	return access == nil || allowed(access.Write, path)
+}
+
+func (access *Access) canDelete(path string) bool {
+	return access == nil || allowed(access.Delete, path)
+}
+
+// Whether a path should be listed to the user: it is readable, or is a folder
+// on the way to something that is.
+func (access *Access) canList(path string) bool {
+	if access.canRead(path) {
+		return true
+	}
+
+	path = filepath.Clean(path)
+	for _, subtree := range(access.Read) {
+		if path == "." || strings.HasPrefix(subtree, path + string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the user may read a path under root, both as given and with any
+// links in it resolved, so that links can't be used to reach other subtrees,
+// Zync's own folder or anything outside of the root.
+func canReadResolved(root string, access *Access, path string) bool {
+	if !access.canRead(path) {
+		return false
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err != nil {
+		// Nothing there to read.
+		return true
+	}
+
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	return err == nil && validPath(rel) && access.canRead(rel)
+}
+
+// Resolves any links in the folders that a path (relative to root) is in, but
+// not the path itself, returning where it leads relative to the root. Returns
+// false if that is outside of the root. Only the deepest of the folders that
+// exists is resolved, since the rest are yet to be created.
+func resolveParent(root, path string) (string, bool) {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", false
+	}
+
+	path = filepath.Clean(path)
+	dir, rest := filepath.Dir(path), filepath.Base(path)
+	for {
+		resolved, err := filepath.EvalSymlinks(filepath.Join(root, dir))
+		if err == nil {
+			rel, err := filepath.Rel(resolvedRoot, resolved)
+			if err != nil || pathEscapes(rel) {
+				return "", false
+			}
+			return filepath.Join(rel, rest), true
+		} else if dir == "." {
+			return "", false
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Whether the user may write a path under root, both as given and with any
+// links in the folders it is in resolved, so that links can't be used to
+// write to other subtrees, Zync's own folder or outside of the root.
+func canWriteResolved(root string, access *Access, path string) bool {
+	resolved, ok := resolveParent(root, path)
+	return ok && validPath(resolved) && access.canWrite(path) && access.canWrite(resolved)
+}
+
+// Likewise, whether the user may delete a path under root.
+func canDeleteResolved(root string, access *Access, path string) bool {
+	resolved, ok := resolveParent(root, path)
+	return ok && validPath(resolved) && access.canDelete(path) && access.canDelete(resolved)
+}
+
+// Leaves the files that the user may not see out of an enumeration. Hard links
+// to files that the user may not read are sent as copies instead, so that the
+// paths of those files aren't given away.
+func filterFiles(root string, files <-chan FileInfo, access *Access) (<-chan FileInfo) {
+	if access == nil || access.Read == nil {
+		return files
+	}
+
+	out := make(chan FileInfo)
+	go func() {
+		defer close(out)
+
+		for fi := range(files) {
+			if !access.canList(fi.Path) {
+				continue
+			}
+			if fi.LinkTo != "" && !canReadResolved(root, access, fi.LinkTo) {
+				fi.LinkTo = ""
+			}
+			out <- fi
+		}
+	}()
+
+	return out
+}
+
+// Applies an access rule from a "[user.{name}]" section of the config file.
+func setAccessOption(access *Access, key string, value interface{}) error {
+	subtrees, err := configList(key, value)
+	if err != nil {
+		return err
+	}
+
+	for i, subtree := range(subtrees) {
+		if pathEscapes(subtree) {
+			return fmt.Errorf("%s must only list paths within the share, found %s", key, subtree)
+		}
+		subtrees[i] = filepath.Clean(subtree)
+	}
+
+	switch key {
+	case "read":
+		access.Read = subtrees
+	case "write":
+		access.Write = subtrees
+	case "delete":
+		access.Delete = subtrees
+	}
+	return nil
+}
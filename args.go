@@ -1,59 +1,311 @@
 package main
 
 import "fmt"
+import "io"
+import "os"
+import "strconv"
+import "strings"
 
-// Looks for the named flag in the list of arguments. If it is found, returns
-// true and the argument list minus that argument.
-func argFlag(args []string, names ...string) (bool, []string) {
-	names = normalizeOptionNames(names...)
+// Run modes, which options can be limited to.
+const (
+	modeAny = ""
+	modeServer = "server"
+	modeClient = "client"
+)
 
-	for i, arg := range(args) {
-		for _, name := range(names) {
-			if arg == name {
-				return true, append(args[:i], args[i+1:]...)
+// The option that selects each mode, for error messages.
+var modeOptions = map[string]string {
+	modeServer: "--server (-s)",
+	modeClient: "--connect (-c)",
+}
+
+// Commands, given as the first argument, and the mode that each runs in.
+// --server and --connect are the same as serve and sync.
+var commands = map[string]string {
+	"serve": modeServer,
+	"sync": modeClient,
+	"status": modeClient,
+	"ls": modeClient,
+	"get": modeClient,
+	"put": modeClient,
+}
+
+// A command-line option, which is either a flag or takes a value.
+type option struct {
+	long string
+	short string
+	mode string
+	help string
+
+	// Name of the value in the usage text; "" for flags.
+	value string
+
+	// Environment variable that gives the option a default; "" for none.
+	env string
+
+	// Whether giving the option selects its mode.
+	selectsMode bool
+
+	// Parses and stores a value. Flags are given "true" when they are set.
+	set func(value string) error
+}
+
+// The option's name, as used in messages.
+func (opt *option) String() string {
+	if opt.short != "" {
+		return fmt.Sprintf("--%s (-%s)", opt.long, opt.short)
+	}
+	return "--" + opt.long
+}
+
+func newOption(mode, long, short, value, help string, set func(string) error) *option {
+	return &option {
+		long: long,
+		short: short,
+		mode: mode,
+		help: help,
+		value: value,
+		env: "ZYNC_" + strings.ToUpper(strings.Replace(long, "-", "_", -1)),
+		set: set,
+	}
+}
+
+func flagOption(p *bool, mode, long, short, help string) *option {
+	var opt *option
+	opt = newOption(mode, long, short, "", help, func(value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false.", opt)
+		}
+		*p = b
+		return nil
+	})
+	return opt
+}
+
+func stringOption(p *string, mode, long, short, value, help string) *option {
+	return newOption(mode, long, short, value, help, func(value string) error {
+		*p = value
+		return nil
+	})
+}
+
+// An option whose value must be a number from min to max, or at least min if
+// max is negative.
+func intOption(p *int, mode, long, short, value, help string, min, max int) *option {
+	var opt *option
+	opt = newOption(mode, long, short, value, help, func(value string) error {
+		n, err := strconv.ParseInt(value, 10, 0)
+		if err != nil || int(n) < min || (max >= 0 && int(n) > max) {
+			switch {
+			case max >= 0:
+				return fmt.Errorf("%s must be a number from %d to %d.", opt, min, max)
+			case min > 0:
+				return fmt.Errorf("%s must be a positive number.", opt)
+			default:
+				return fmt.Errorf("%s must be a number.", opt)
 			}
 		}
-	}
+		*p = int(n)
+		return nil
+	})
+	return opt
+}
 
-	return false, args
+// An option whose value must be one of the choices.
+func choiceOption(p *string, mode, long, short, help string, choices ...string) *option {
+	var opt *option
+	opt = newOption(mode, long, short, strings.Join(choices, "|"), help, func(value string) error {
+		for _, choice := range(choices) {
+			if value == choice {
+				*p = value
+				return nil
+			}
+		}
+		quoted := make([]string, len(choices))
+		for i, choice := range(choices) {
+			quoted[i] = "'" + choice + "'"
+		}
+		return fmt.Errorf("%s must be %s or %s.", opt, strings.Join(quoted[:len(quoted) - 1], ", "), quoted[len(quoted) - 1])
+	})
+	return opt
 }
 
-// Looks for the named option in the argument list. If it is found, returns
-// true, the associated (subsequent) value, and the argument list with both of
-// those parameters removed. If the option is found with no value, returns true
-// and an empty string, and only the option itself removed.
-func argOption(args []string, names ...string) (bool, string, []string) {
-	names = normalizeOptionNames(names...)
+// An option as it was given on the command line.
+type optionUse struct {
+	opt *option
+	value string
+}
+
+// Parses the command line (without the program name), setting the options
+// given there or in the environment; options on the command line take
+// precedence. Returns the command and mode selected, if any, and the
+// arguments that aren't options.
+func parseArgs(opts []*option, args []string) (command, mode string, rest []string, err error) {
+	if len(args) > 0 && commands[args[0]] != "" {
+		command, mode = args[0], commands[args[0]]
+		args = args[1:]
+	}
+
+	var uses []optionUse
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			rest = append(rest, args[i + 1:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "--"):
+			name, value := arg[2:], ""
+			hasValue := false
+			if eq := strings.Index(name, "="); eq >= 0 {
+				name, value, hasValue = name[:eq], name[eq + 1:], true
+			}
+
+			opt := findOption(opts, func(opt *option) bool { return opt.long == name })
+			if opt == nil {
+				return "", "", nil, fmt.Errorf("Unknown option --%s.", name)
+			}
+
+			if opt.value == "" {
+				if !hasValue {
+					value = "true"
+				}
+			} else if !hasValue {
+				if i + 1 >= len(args) {
+					return "", "", nil, fmt.Errorf("%s requires a value.", opt)
+				}
+				i++
+				value = args[i]
+			}
+			uses = append(uses, optionUse { opt, value })
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// Short options can be combined, as in -vk mine; the first one
+			// that takes a value takes the rest of the argument, or the next
+			// one.
+			for j := 1; j < len(arg); j++ {
+				name := arg[j:j + 1]
+				opt := findOption(opts, func(opt *option) bool { return opt.short == name })
+				if opt == nil {
+					return "", "", nil, fmt.Errorf("Unknown option -%s.", name)
+				}
 
-	for i, arg := range(args) {
-		for _, name := range(names) {
-			if arg == name {
-				if len(args) > i + 1 {
-					val := args[i+1]
-					return true, val, append(args[:i], args[i+2:]...)
-				} else {
-					return true, "", append(args[:i], args[i+1:]...)
+				value := "true"
+				if opt.value != "" {
+					if j + 1 < len(arg) {
+						value = arg[j + 1:]
+					} else if i + 1 < len(args) {
+						i++
+						value = args[i]
+					} else {
+						return "", "", nil, fmt.Errorf("%s requires a value.", opt)
+					}
+					j = len(arg)
 				}
+				uses = append(uses, optionUse { opt, value })
 			}
+		default:
+			rest = append(rest, arg)
 		}
 	}
 
-	return false, "", args
-}
+	// Without a command, the mode is selected by --server or --connect.
+	for _, use := range(uses) {
+		opt := use.opt
+		if opt.selectsMode && command != "" {
+			return "", "", nil, fmt.Errorf("%s can't be used with zync %s.", opt, command)
+		}
+		if opt.selectsMode && mode != opt.mode {
+			if mode != "" {
+				return "", "", nil, fmt.Errorf("Only one of %s, %s can be specified.", modeOptions[modeClient], modeOptions[modeServer])
+			}
+			mode = opt.mode
+		}
+	}
+
+	for _, use := range(uses) {
+		if use.opt.mode != modeAny && use.opt.mode != mode {
+			return "", "", nil, fmt.Errorf("%s is a %s option.", use.opt, use.opt.mode)
+		}
+	}
 
-// Prefixes option names with a single- or double-hyphen, based on whether they
-// are single-character or longer, respectively.
-func normalizeOptionNames(names ...string) []string {
-	for i, name := range(names) {
-		if len(name) == 0 {
+	// Defaults from the environment.
+	for _, opt := range(opts) {
+		if opt.env == "" || (opt.mode != modeAny && opt.mode != mode) {
 			continue
 		}
-		if len(name) == 1 {
-			names[i] = fmt.Sprintf("-%s", name)
-		} else {
-			names[i] = fmt.Sprintf("--%s", name)
+		if value := os.Getenv(opt.env); value != "" {
+			if err := opt.set(value); err != nil {
+				return "", "", nil, fmt.Errorf("%s: %s", opt.env, err)
+			}
+		}
+	}
+
+	for _, use := range(uses) {
+		if err := use.opt.set(use.value); err != nil {
+			return "", "", nil, err
+		}
+	}
+
+	return command, mode, rest, nil
+}
+
+func findOption(opts []*option, match func(*option) bool) *option {
+	for _, opt := range(opts) {
+		if match(opt) {
+			return opt
+		}
+	}
+	return nil
+}
+
+// Writes the usage text, listing the options of each mode.
+func usage(w io.Writer, opts []*option) {
+	fmt.Fprintln(w, "Usage:")
+	fmt.Fprintln(w, "  zync serve [options]                     Runs a server.")
+	fmt.Fprintln(w, "  zync sync {remote}[:{path}] [options]    Synchronizes with a server.")
+	fmt.Fprintln(w, "  zync status {remote}[:{path}] [options]  Shows what zync sync would do.")
+	fmt.Fprintln(w, "  zync ls {remote}[:{path}] [options]      Lists the server's files.")
+	fmt.Fprintln(w, "  zync get {remote} {path} [options]       Downloads a file.")
+	fmt.Fprintln(w, "  zync put {remote} {path} [options]       Uploads a file.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "A {remote} is {host}[:{port}][/{share}]. zync --server and zync --connect")
+	fmt.Fprintln(w, "{remote} are the same as zync serve and zync sync {remote}.")
+
+	sections := []struct { mode, title string } {
+		{ modeAny, "Options" },
+		{ modeServer, "Server options" },
+		{ modeClient, "Client options" },
+	}
+
+	syntax := func(opt *option) string {
+		s := "    --" + opt.long
+		if opt.short != "" {
+			s = fmt.Sprintf("-%s, --%s", opt.short, opt.long)
+		}
+		if opt.value != "" {
+			s += " {" + opt.value + "}"
+		}
+		return s
+	}
+
+	width := 0
+	for _, opt := range(opts) {
+		if n := len(syntax(opt)); n > width {
+			width = n
+		}
+	}
+
+	for _, section := range(sections) {
+		fmt.Fprintf(w, "\n%s:\n", section.title)
+		for _, opt := range(opts) {
+			if opt.mode == section.mode {
+				fmt.Fprintf(w, "  %-*s  %s\n", width, syntax(opt), opt.help)
+			}
 		}
 	}
 
-	return names
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Options can also be set with environment variables, named ZYNC_ followed by")
+	fmt.Fprintln(w, "the long name of the option in capitals with hyphens as underscores (such as")
+	fmt.Fprintln(w, "ZYNC_LOG_LEVEL=debug); options on the command line take precedence.")
 }
@@ -0,0 +1,93 @@
+package main
+
+import "encoding/json"
+import "os"
+import "sync"
+import "time"
+
+// An append-only record of everything that clients do on the server, written
+// as one JSON object per line.
+type auditLog struct {
+	mu sync.Mutex
+	path string
+	file *os.File
+}
+
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	Event string `json:"event"`
+	Remote string `json:"remote"`
+	User string `json:"user,omitempty"`
+	Share string `json:"share,omitempty"`
+	Path string `json:"path,omitempty"`
+	Size int64 `json:"size,omitempty"`
+	Result string `json:"result"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Results of audited actions.
+const (
+	auditOK = "ok"
+	auditRefused = "refused"
+	auditFailed = "failed"
+)
+
+var audit auditLog
+
+// Starts writing to the audit log at path (or stops, if it is empty). Does
+// nothing if that log is already open.
+func (log *auditLog) open(path string) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if path == log.path {
+		return nil
+	}
+
+	var file *os.File
+	if path != "" {
+		var err error
+		file, err = os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	if log.file != nil {
+		log.file.Close()
+	}
+	log.path, log.file = path, file
+	return nil
+}
+
+func (log *auditLog) write(entry auditEntry) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if log.file == nil {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err == nil {
+		_, err = log.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		logWarning("Failed to write to audit log:", err)
+	}
+}
+
+// Records something that the client on a session did, and how it turned out.
+func (s *session) audit(event, path string, size int64, result, reason string) {
+	audit.write(auditEntry {
+		Time: time.Now().UTC(),
+		Event: event,
+		Remote: s.addr,
+		User: s.user,
+		Share: s.share,
+		Path: path,
+		Size: size,
+		Result: result,
+		Reason: reason,
+	})
+}
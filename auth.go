@@ -0,0 +1,89 @@
+package main
+
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "io/ioutil"
+import "net"
+import "os"
+import "strings"
+
+// A user that clients may log in as.
+type User struct {
+	Name string
+	Token string
+
+	// What the user may do; nil if they may do anything.
+	Access *Access
+}
+
+// Clients prove that they know their user's token without sending it: the
+// server sends a random challenge, and the client answers with an HMAC of the
+// challenge keyed by the token. Servers without users send an empty challenge
+// and accept anyone.
+func authProof(token string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// Challenges a client to prove its identity. Returns the user it authenticated
+// as (or nil if the server has no users), and whether it may go on. The name
+// it claimed is returned either way, for logging.
+func authenticate(conn net.Conn, config *Config) (*User, string, bool) {
+	name, err := expectString(conn)
+	checkError(err)
+
+	var challenge []byte
+	if len(config.Users) > 0 {
+		challenge = make([]byte, 32)
+		_, err = rand.Read(challenge)
+		checkError(err)
+	}
+	checkError(send(conn, challenge))
+
+	proof, err := expectBytes(conn)
+	checkError(err)
+
+	var user *User
+	ok := true
+	if len(config.Users) > 0 {
+		user = config.Users[name]
+		ok = user != nil && hmac.Equal(proof, authProof(user.Token, challenge))
+	}
+
+	checkError(send(conn, ok))
+	return user, name, ok
+}
+
+// Answers the server's challenge, as the user given by --user.
+func login(conn net.Conn) {
+	checkError(send(conn, userName))
+	challenge, err := expectBytes(conn)
+	checkError(err)
+
+	var proof []byte
+	if len(challenge) > 0 {
+		proof = authProof(userToken(), challenge)
+	}
+	checkError(send(conn, proof))
+
+	accepted, err := expectBool(conn)
+	checkError(err)
+	if !accepted {
+		logError("Server rejected credentials for user", userName)
+		os.Exit(errorStatus)
+	}
+}
+
+// The token to log in with: read from --token-file if it was given, or the
+// ZYNC_TOKEN environment variable otherwise.
+func userToken() string {
+	if tokenFile == "" {
+		return os.Getenv("ZYNC_TOKEN")
+	}
+
+	data, err := ioutil.ReadFile(tokenFile)
+	checkError(err)
+	return strings.TrimSpace(string(data))
+}
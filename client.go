@@ -2,6 +2,8 @@ package main
 
 import "bufio"
 import "fmt"
+import "io"
+import "io/ioutil"
 import "net"
 import "os"
 import "path/filepath"
@@ -11,6 +13,17 @@ import "time"
 
 var portRx = regexp.MustCompile(":\\d+$")
 
+// Protocol extensions negotiated with the server.
+var extensions Extensions
+
+// Folders created or written into on the client during the current
+// synchronization.
+var createdDirs dirFixups
+
+// Folders that both nodes have, as the client has them, until anything is sent
+// into them.
+var sharedDirs = make(map[string]FileInfo)
+
 type ConflictType int
 const (
 	// Different versions of the file exist on the server and the client.
@@ -31,29 +44,149 @@ func runClient(connectUri string) {
 		}
 	}()
 
-	root, err := os.Getwd()
-	checkError(err)
+	root := rootDir
+	connectUri = withPort(connectUri)
+
+	logInfo("Starting Zync client.")
+	logInfo("Root folder is", root)
+
+	removeTempFiles(root)
+	purgeTrash(root)
+	checkDeletions(connectUri, root)
+
+	// Once every attempt is over, set the permissions and times of new
+	// folders; until then, later attempts may still need to write to them.
+	defer createdDirs.apply(root)
+
+	// If the connection is lost, reconnect and pick up after the last path
+	// that was completely synchronized, backing off between attempts. The
+	// backoff is reset whenever an attempt makes progress.
+	delay := retryDelay
+	failures := 0
+	for {
+		before := syncProgress.lastFinished()
+
+		err := syncWith(connectUri, root, before)
+		if err == nil {
+			break
+		}
+
+		if syncProgress.lastFinished() != before {
+			failures = 0
+			delay = retryDelay
+		}
+
+		failures++
+		if !isConnectionError(err) || failures > retries {
+			panic(err)
+		}
 
-	match := portRx.FindString(connectUri)
-	if match == "" {
-		connectUri = fmt.Sprintf("%s:%d", connectUri, port)
+		if err == ErrServerShutdown {
+			logWarning("Server is shutting down; reconnecting in", delay)
+		} else {
+			logWarning("Connection lost; reconnecting in", delay)
+		}
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
 	}
 
-	logInfo("Starting Zync client.")
-	logInfo("Working directory is", root)
+	logInfo("Complete, disconnecting.")
+}
+
+// Lists the versions that the server keeps of a path, or restores one of them,
+// instead of synchronizing.
+func runVersionCommand(connectUri string) {
+	defer func() {
+		if err := recover(); err != nil {
+			os.Exit(1)
+		}
+	}()
+
+	conn := connect(withPort(connectUri))
+	defer disconnect(conn)
+
+	if listVersionsOf != "" {
+		versions := requestVersionList(conn, listVersionsOf)
+		if len(versions) == 0 {
+			logInfo("No versions of", listVersionsOf)
+		}
+		for _, v := range(versions) {
+			fmt.Printf("%s\t%d\t%s\n", v.version, v.info.Size, v.info.ModTime.Format(time.RFC3339))
+		}
+		return
+	}
+
+	version := restoreVersionId
+	if version == "" {
+		versions := requestVersionList(conn, restorePath)
+		if len(versions) == 0 {
+			logError("No versions of", restorePath)
+			os.Exit(1)
+		}
+		version = versions[len(versions) - 1].version
+	}
+
+	if requestVersionRestore(conn, restorePath, version) {
+		logInfo("Restored version", version, "of", restorePath)
+	} else {
+		logError("Server refused to restore version", version, "of", restorePath)
+		os.Exit(1)
+	}
+}
+
+// Adds the default port to a server address, unless it has one.
+func withPort(connectUri string) string {
+	if portRx.FindString(connectUri) == "" {
+		return fmt.Sprintf("%s:%d", connectUri, port)
+	}
+	return connectUri
+}
+
+// Initial and maximum delays between attempts to reconnect to the server.
+const retryDelay = 1 * time.Second
+const maxRetryDelay = 30 * time.Second
+
+// Connects to the server and synchronizes every path after the specified one
+// (or all paths, if it is empty). Returns the error that interrupted the
+// synchronization, if any.
+func syncWith(connectUri, root, after string) (err interface{}) {
+	defer func() {
+		err = recover()
+	}()
+
+	syncProgress.reset()
 
 	logInfo("Connecting to Zync server at", connectUri)
-	conn, err := net.Dial("tcp", connectUri)
-	checkError(err)
+	conn := connect(connectUri)
 	defer conn.Close()
 
-	// Version Check
-	checkError(send(conn, ProtoVersion))
-	accepted, err := expectBool(conn)
-	checkError(err)
-	if !accepted {
-		logError("Server rejected protocol version", ProtoVersion)
-		os.Exit(1)
+	// File contents are transferred over additional connections when more
+	// than one job is requested; the main connection is still used to walk the
+	// server's files and request deletions.
+	if jobs > 1 {
+		logVerbose("Opening", jobs, "transfer connections.")
+		transfers = newTransferPool(connectUri, jobs)
+		defer func() {
+			// If synchronization was interrupted, let any transfers that are
+			// still running finish, so that they count towards the progress
+			// that is resumed from.
+			if transfers != nil {
+				transfers.close()
+				transfers = nil
+			}
+		}()
+	}
+
+	scopeEnumeration(conn)
+	if after != "" {
+		logInfo("Resuming after", after)
+		if filesFrom == "" {
+			requestEnumerationAfter(conn, after)
+		}
 	}
 
 	// Synchronization process:
@@ -70,66 +203,217 @@ func runClient(connectUri string) {
 	// 6. If the files are different, use the chosen conflict resolution
 	// mechanism to determine which side 'wins'; the client either requests the
 	// file from the server or sends its own file to the server.
-	myFiles := enumerateFiles(root)
+	comparePaths(conn, root, after, func(path string, mine, theirs *FileInfo) {
+		syncProgress.begin(path)
+		resolve(conn, root, mine, theirs)
+		syncProgress.end()
+	})
+
+	if transfers != nil {
+		err := transfers.close()
+		transfers = nil
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	disconnect(conn)
+	return nil
+}
+
+// Whether an error raised during synchronization was caused by the connection
+// to the server (as opposed to, say, a local filesystem error), and so may be
+// fixed by reconnecting.
+func isConnectionError(err interface{}) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == ErrServerShutdown {
+		return true
+	}
+
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// Connects to the server and negotiates the protocol version.
+func connect(connectUri string) net.Conn {
+	conn, err := net.Dial("tcp", connectUri)
+	checkError(err)
+
+	// Version Check
+	checkError(send(conn, ProtoVersion))
+	accepted, err := expectBool(conn)
+	checkError(err)
+	if !accepted {
+		logError("Server rejected protocol version", ProtoVersion)
+		os.Exit(errorStatus)
+	}
+
+	login(conn)
+
+	// Share selection.
+	checkError(send(conn, shareName))
+	accepted, err = expectBool(conn)
+	checkError(err)
+	if !accepted {
+		logError("Server has no share named", shareName)
+		os.Exit(errorStatus)
+	}
+
+	// Extensions; the server replies with the subset that it supports.
+	requested := requestedExtensions() & supportedExtensions
+	checkError(send(conn, uint32(requested)))
+	ext, err := expectUint32(conn)
+	checkError(err)
+
+	extensions = Extensions(ext)
+	if extensions != requested {
+		logWarning("Server does not support", extensionNames(requested &^ extensions))
+	}
+
+	return conn
+}
+
+// Closes the connection once the server has finished handling everything that
+// was sent on it; the server closes its end when it reads EOF from the client.
+func disconnect(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+		io.Copy(ioutil.Discard, conn)
+	}
+	conn.Close()
+}
+
+// What a synchronization does about a path.
+type syncAction int
+const (
+	// Nothing; both nodes have the same version.
+	actionNone syncAction = iota
+
+	actionSend
+	actionReceive
+
+	// Delete the server's or the client's version (see --delete).
+	actionDeleteTheirs
+	actionDeleteMine
+
+	// Ask the user (see --interactive).
+	actionAsk
+
+	// One node has a folder where the other has a file.
+	actionTreeConflict
 
+	// The versions differ, but their mod times match, so neither wins.
+	actionUnresolved
+)
+
+// Decides what to do about a path, given the client's and the server's
+// versions of it (nil if they don't have one).
+func chooseAction(mine, theirs *FileInfo) syncAction {
+	switch {
+	case mine == nil:
+		if interactive {
+			return actionAsk
+		} else if keepWhose == "mine" && autoDelete {
+			return actionDeleteTheirs
+		}
+		return actionReceive
+	case theirs == nil:
+		if interactive {
+			return actionAsk
+		} else if keepWhose == "theirs" && autoDelete {
+			return actionDeleteMine
+		}
+		return actionSend
+	case mine.IsDir || theirs.IsDir:
+		if mine.IsDir != theirs.IsDir {
+			return actionTreeConflict
+		}
+		return actionNone
+	case mine.IsLink() && theirs.IsLink() && mine.Target == theirs.Target:
+		return actionNone
+	case mine.Size == theirs.Size && mine.ModTime.Equal(theirs.ModTime):
+		return actionNone
+	case interactive:
+		return actionAsk
+	case keepWhose == "mine" || (keepWhose == "" && mine.ModTime.After(theirs.ModTime)):
+		return actionSend
+	case keepWhose == "theirs" || (keepWhose == "" && theirs.ModTime.After(mine.ModTime)):
+		return actionReceive
+	default:
+		return actionUnresolved
+	}
+}
+
+// Walks the client's and the server's files together, calling visit with each
+// path after the specified one (or every path, if it is empty) and each node's
+// version of it (nil if it doesn't have one). With --files-from, only the
+// listed paths are looked up; otherwise both nodes enumerate their files.
+func comparePaths(conn net.Conn, root, after string, visit func(path string, mine, theirs *FileInfo)) {
+	if filesFrom != "" {
+		compareListedPaths(conn, root, after, visit)
+		return
+	}
+
+	myFiles := enumerateFilesAfter(root, syncPath, after, extensions, false)
 	myNext, myAny := <-myFiles
 	svrNext, svrAny := requestNextFileInfo(conn)
 	for myAny || svrAny {
 		if svrAny && (!myAny || svrNext.Path < myNext.Path) {
-			if interactive {
-				promptForAction(conn, root, Missing, svrNext, myNext)
-			} else if keepWhose == "mine" && autoDelete {
-				requestFileDeletion(conn, svrNext.Path)
-			} else {
-				requestAndSaveFile(conn, root, svrNext, false)
-			}
+			visit(svrNext.Path, nil, &svrNext)
 			svrNext, svrAny = requestNextFileInfo(conn)
 		} else if myAny && (!svrAny || svrNext.Path > myNext.Path) {
-			if interactive {
-				promptForAction(conn, root, New, svrNext, myNext)
-			} else if keepWhose == "theirs" && autoDelete {
-				deleteLocalFile(root, myNext.Path)
-			} else {
-				offerAndSendFile(conn, root, myNext)
-			}
+			visit(myNext.Path, &myNext, nil)
 			myNext, myAny = <-myFiles
 		} else {
-			resolve(conn, root, myNext, svrNext)
+			visit(myNext.Path, &myNext, &svrNext)
 			myNext, myAny = <-myFiles
 			svrNext, svrAny = requestNextFileInfo(conn)
 		}
 	}
-
-	logInfo("Complete, disconnecting.")
 }
 
-func resolve(conn net.Conn, root string, mine FileInfo, theirs FileInfo) {
-	assert(mine.Path == theirs.Path, "Cannot resolve differing paths.")
-
-	if mine.IsDir || theirs.IsDir {
-		if mine.IsDir != theirs.IsDir {
-			logError("Tree conflict at", mine.Path)
+// Does whatever chooseAction decides for a path, given the client's and the
+// server's versions of it (nil if they don't have one).
+func resolve(conn net.Conn, root string, mine, theirs *FileInfo) {
+	if mine != nil && theirs != nil {
+		assert(mine.Path == theirs.Path, "Cannot resolve differing paths.")
+		if !mine.IsDir && !theirs.IsDir {
+			logVerbose("Comparing", mine.Path)
 		}
-		return
 	}
 
-	logVerbose("Comparing", mine.Path)
-	if mine.Size == theirs.Size && mine.ModTime.Equal(theirs.ModTime) {
-		logVerbose("Files match, skipping.")
-		return
-	}
-
-	if interactive {
-		promptForAction(conn, root, Conflict, theirs, mine)
-	} else if keepWhose == "mine" || (keepWhose == "" && mine.ModTime.After(theirs.ModTime)) {
+	switch chooseAction(mine, theirs) {
+	case actionNone:
+		if !mine.IsDir {
+			logVerbose("Files match, skipping.")
+		} else if theirs.IsDir {
+			// Either node's version may end up with files written into it.
+			createdDirs.saw(*theirs)
+			sharedDirs[mine.Path] = *mine
+		}
+	case actionTreeConflict:
+		logError("Tree conflict at", mine.Path)
+	case actionAsk:
+		switch {
+		case mine == nil:
+			promptForAction(conn, root, Missing, *theirs, FileInfo{})
+		case theirs == nil:
+			promptForAction(conn, root, New, FileInfo{}, *mine)
+		default:
+			promptForAction(conn, root, Conflict, *theirs, *mine)
+		}
+	case actionDeleteTheirs:
+		requestFileDeletion(conn, theirs.Path)
+	case actionDeleteMine:
+		deleteLocalFile(root, mine.Path)
+	case actionSend:
 		// Use the client's version.
 		logVerbose("Sending", mine.Path, "to server.")
-		offerAndSendFile(conn, root, mine)
-	} else if keepWhose == "theirs" || (keepWhose == "" && theirs.ModTime.After(mine.ModTime)) {
+		offerAndSendFile(conn, root, *mine)
+	case actionReceive:
 		// Use the server's version.
 		logVerbose("Requesting", theirs.Path, "from server.")
-		requestAndSaveFile(conn, root, theirs, true)
-	} else {
+		requestAndSaveFile(conn, root, *theirs, mine != nil)
+	default:
 		// Could not automatically resolve.
 		logWarning("Failed to resolve", mine.Path, "automatically; mod times match.")
 	}
@@ -262,10 +546,15 @@ func requestUserInput(prompt, dflt string, options...string) string {
 	}
 }
 
-// Deletes the client's version of a file that has been deleted on the server.
+// Deletes the client's version of a file that has been deleted on the server,
+// moving it to the trash unless --no-trash was specified.
 func deleteLocalFile(root, name string) {
 	logInfo("Deleting", name)
-	checkError(os.RemoveAll(filepath.Join(root, name)))
+	if noTrash {
+		checkError(os.RemoveAll(filepath.Join(root, name)))
+	} else {
+		checkError(moveToTrash(root, name))
+	}
 }
 
 // Asks the server to delete their version of a file that has been deleted on
@@ -286,30 +575,87 @@ func requestFileDeletion(conn net.Conn, path string) {
 // location on disk.
 func requestAndSaveFile(conn net.Conn, root string, fi FileInfo, overwrite bool) {
 	abs := filepath.Join(root, fi.Path)
+	if filesFrom != "" {
+		receiveParents(conn, root, fi.Path)
+	}
+	createdDirs.writing(fi.Path)
 
 	// If this is a folder, just go ahead and create it; no need to ask the
 	// server for anything.
 	if fi.IsDir {
 		logVerbose("Creating folder", fi.Path)
-		checkError(os.Mkdir(abs, os.ModeDir | fi.Mode))
+		checkError(createdDirs.makeDir(root, fi))
 		return
 	}
 
-	logInfo("Requesting", fi.Path, "from server.")
-	checkError(send(conn, FileRequest { Path: fi.Path }))
-	yes, err := expectBool(conn)
-	checkError(err)
+	// Likewise for links.
+	if fi.IsLink() {
+		if safeLinks && linkEscapes(fi) {
+			logWarning("Refusing link that escapes the root:", fi.Path, "->", fi.Target)
+			return
+		}
 
-	if yes {
-		logVerbose("Receiving", fi.Path, "from server.")
-		checkError(recvFile(conn, fi, abs, overwrite))
-	} else {
-		logWarning("Server refused to provide", fi.Path)
+		logVerbose("Creating link", fi.Path)
+		checkError(createSymlink(root, fi, overwrite))
+		return
+	}
+
+	// Hard links are recreated locally if the file they link to has already
+	// been received (waiting for any transfers in progress to finish first).
+	if fi.LinkTo != "" {
+		flushTransfers()
+		if restoreHardLink(root, fi) {
+			return
+		}
 	}
+
+	transfer(conn, func(conn net.Conn) {
+		logInfo("Requesting", fi.Path, "from server.")
+		checkError(send(conn, FileRequest { Path: fi.Path }))
+		yes, err := expectBool(conn)
+		checkError(err)
+
+		if yes {
+			logVerbose("Receiving", fi.Path, "from server.")
+			checkError(recvFile(conn, fi, abs, overwrite, extensions))
+		} else {
+			logWarning("Server refused to provide", fi.Path)
+		}
+	})
 }
 
 // Offers a file to the server and sends it if the server accepts.
 func offerAndSendFile(conn net.Conn, root string, fi FileInfo) {
+	if filesFrom != "" {
+		sendParents(conn, root, fi.Path)
+	}
+
+	// Offering a folder that the server already has tells it the folder's mod
+	// time, to restore once the file has been written into it.
+	if dir, ok := sharedDirs[filepath.Dir(fi.Path)]; ok {
+		delete(sharedDirs, dir.Path)
+		offerAndSend(conn, root, dir)
+	}
+
+	// Folders (and links, which have no contents either) are offered on the
+	// main connection, so that the server has created them before any of
+	// their contents arrive. Hard links are too, once the file that they link
+	// to has been sent.
+	if fi.IsDir || fi.IsLink() || fi.LinkTo != "" {
+		if fi.LinkTo != "" {
+			flushTransfers()
+		}
+		offerAndSend(conn, root, fi)
+		return
+	}
+
+	transfer(conn, func(conn net.Conn) {
+		offerAndSend(conn, root, fi)
+	})
+}
+
+// Returns whether the server accepted the file.
+func offerAndSend(conn net.Conn, root string, fi FileInfo) bool {
 	logVerbose("Offering", fi.Path, "to server.")
 	checkError(send(conn, FileOffer { Info: fi }))
 
@@ -319,10 +665,48 @@ func offerAndSendFile(conn net.Conn, root string, fi FileInfo) {
 	if yes {
 		logInfo("Sending", fi.Path, "to server.")
 		path := filepath.Join(root, fi.Path)
-		checkError(sendFile(conn, fi, path))
+		checkError(sendFile(conn, fi, path, extensions))
+
+		// Server confirms once the file is in place, so that it's there for
+		// anything (such as a hard link) that depends on it.
+		_, err = expectBool(conn)
+		checkError(err)
 	} else {
 		logVerbose("Server refused to accept", fi.Path)
 	}
+	return yes
+}
+
+// Asks the server to skip ahead in its enumeration to the first file after the
+// specified path.
+func requestEnumerationAfter(conn net.Conn, path string) {
+	checkError(send(conn, EnumerateAfter { Path: path }))
+	yes, err := expectBool(conn)
+	checkError(err)
+	assert(yes, "Server refused to resume enumeration.")
+}
+
+// Restricts the server's enumeration to --path, if it was given.
+func scopeEnumeration(conn net.Conn) {
+	if syncPath == "." {
+		return
+	}
+
+	logVerbose("Only synchronizing", syncPath)
+	if !requestEnumerationSubtree(conn, syncPath) {
+		err := fmt.Errorf("Server refused to synchronize %s.", syncPath)
+		logError(err)
+		panic(err)
+	}
+}
+
+// Asks the server to only enumerate the files at and under the specified path.
+// Returns false if it refuses, such as when there is nothing there.
+func requestEnumerationSubtree(conn net.Conn, path string) bool {
+	checkError(send(conn, EnumerateSubtree { Path: path }))
+	yes, err := expectBool(conn)
+	checkError(err)
+	return yes
 }
 
 // Asks the server for and receives the next file that it sees.
@@ -339,3 +723,64 @@ func requestNextFileInfo(conn net.Conn) (FileInfo, bool) {
 		return FileInfo{}, false
 	}
 }
+
+// Asks the server for what it has at a single path, if anything.
+func requestFileInfo(conn net.Conn, path string) (FileInfo, bool) {
+	checkError(send(conn, FileInfoRequest { Path: path }))
+	yes, err := expectBool(conn)
+	checkError(err)
+
+	if yes {
+		fi, err := expectFileInfo(conn)
+		checkError(err)
+		return fi, true
+	} else {
+		return FileInfo{}, false
+	}
+}
+
+// Asks the server for a checksum of a file. Returns false if it refuses.
+func requestHash(conn net.Conn, path string) ([]byte, bool) {
+	checkError(send(conn, HashRequest { Path: path }))
+	yes, err := expectBool(conn)
+	checkError(err)
+
+	if yes {
+		sum, err := expectBytes(conn)
+		checkError(err)
+		return sum, true
+	} else {
+		return nil, false
+	}
+}
+
+// A version of a file kept by the server.
+type storedVersion struct {
+	version string
+	info FileInfo
+}
+
+// Asks the server for the versions that it keeps of a path, oldest first.
+func requestVersionList(conn net.Conn, path string) (versions []storedVersion) {
+	checkError(send(conn, VersionListRequest { Path: path }))
+	count, err := expectInt32(conn)
+	checkError(err)
+
+	for i := int32(0); i < count; i++ {
+		version, err := expectString(conn)
+		checkError(err)
+		fi, err := expectFileInfo(conn)
+		checkError(err)
+
+		versions = append(versions, storedVersion { version, fi })
+	}
+	return
+}
+
+// Asks the server to put a stored version of a path back in place.
+func requestVersionRestore(conn net.Conn, path, version string) bool {
+	checkError(send(conn, VersionRestoreRequest { Path: path, Version: version }))
+	yes, err := expectBool(conn)
+	checkError(err)
+	return yes
+}
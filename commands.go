@@ -0,0 +1,387 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "net"
+import "os"
+import "path/filepath"
+import "regexp"
+import "strings"
+import "time"
+
+// Commands other than syncing, which each make a single request (or a walk of
+// the server's files) over one connection.
+
+// Splits a remote given as {host}[:{port}][/{share}][:{path}] into the
+// address to connect to, the share and the path. A number after the host is
+// taken to be the port.
+func parseRemote(remote string) (connectUri, share, path string) {
+	connectUri = remote
+	if i := strings.IndexAny(remote, "/:"); i >= 0 {
+		connectUri = remote[:i]
+		rest := remote[i:]
+
+		if m := remotePortRx.FindString(rest); m != "" && (len(m) == len(rest) || strings.ContainsAny(rest[len(m):len(m) + 1], "/:")) {
+			connectUri += m
+			rest = rest[len(m):]
+		}
+		if strings.HasPrefix(rest, "/") {
+			share = rest[1:]
+			rest = ""
+			if j := strings.Index(share, ":"); j >= 0 {
+				share, rest = share[:j], share[j:]
+			}
+		}
+		path = strings.TrimPrefix(rest, ":")
+	}
+	return
+}
+
+var remotePortRx = regexp.MustCompile("^:\\d+")
+
+// Runs one of the commands below, exiting with an error if it panics.
+func runCommand(run func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			os.Exit(errorStatus)
+		}
+	}()
+	run()
+}
+
+// Lists the server's files at and under path like ls -lR: the contents of
+// each folder in turn, starting with path itself. With --glob, only entries
+// whose names match are listed; with --json, each entry is printed as a JSON
+// object on its own line instead.
+func runList(connectUri, path string) {
+	runCommand(func() {
+		conn := connect(withPort(connectUri))
+		defer disconnect(conn)
+
+		path = filepath.Clean(path)
+		if path != "." && !requestEnumerationSubtree(conn, path) {
+			logError("Cannot list", path, "on the server.")
+			os.Exit(1)
+		}
+
+		// Gather each folder's entries, as they are enumerated depth first.
+		var top *FileInfo
+		contents := make(map[string][]FileInfo)
+		for {
+			fi, ok := requestNextFileInfo(conn)
+			if !ok {
+				break
+			}
+
+			if fi.Path == path {
+				top = &fi
+			} else {
+				dir := filepath.Dir(fi.Path)
+				contents[dir] = append(contents[dir], fi)
+			}
+		}
+		if top == nil && path != "." {
+			logError("Nothing at", path, "on the server.")
+			os.Exit(1)
+		} else if top == nil {
+			// Drop boxes list nothing.
+			return
+		}
+
+		if listJSON {
+			listJSONEntries(top, contents)
+		} else if !top.IsDir {
+			if listMatches(*top) {
+				fmt.Println(listEntry(*top, 1))
+			}
+		} else {
+			listFolder(top.Path, contents, true)
+		}
+	})
+}
+
+// Whether an entry matches --glob, by name, or by path if the pattern has a
+// slash in it.
+func listMatches(fi FileInfo) bool {
+	if listGlob == "" {
+		return true
+	}
+
+	name := filepath.Base(fi.Path)
+	if strings.Contains(listGlob, "/") {
+		name = filepath.ToSlash(fi.Path)
+	}
+	matched, _ := filepath.Match(listGlob, name)
+	return matched
+}
+
+// Prints a folder's matching entries, then each of its subfolders in turn.
+// Folders with no matching entries are left out, other than the first.
+func listFolder(dir string, contents map[string][]FileInfo, first bool) {
+	var matching []FileInfo
+	width := 1
+	for _, fi := range(contents[dir]) {
+		if listMatches(fi) {
+			matching = append(matching, fi)
+			if n := len(fmt.Sprint(fi.Size)); n > width {
+				width = n
+			}
+		}
+	}
+
+	if len(matching) > 0 || first {
+		if !first {
+			fmt.Println()
+		}
+		fmt.Printf("%s:\n", filepath.ToSlash(dir))
+		for _, fi := range(matching) {
+			fmt.Println(listEntry(fi, width))
+		}
+	}
+
+	for _, fi := range(contents[dir]) {
+		if fi.IsDir {
+			listFolder(fi.Path, contents, false)
+		}
+	}
+}
+
+// Formats an entry as ls -l does, with ISO dates and without the link count,
+// owner and group. Sizes are padded to the width given.
+func listEntry(fi FileInfo, width int) string {
+	mode := fi.Mode.String()
+	if fi.IsLink() {
+		mode = "l" + mode[1:]
+	}
+
+	line := fmt.Sprintf("%s %*d %s %s", mode, width, fi.Size, fi.ModTime.Local().Format("2006-01-02 15:04"), filepath.Base(fi.Path))
+	if fi.IsLink() {
+		line += " -> " + fi.Target
+	}
+	return line
+}
+
+// An entry in the output of ls --json.
+type listedFile struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+	Size int64 `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Target string `json:"target,omitempty"`
+}
+
+// Prints each matching entry under top (or top itself, if it isn't a folder)
+// as a JSON object, in the order enumerated.
+func listJSONEntries(top *FileInfo, contents map[string][]FileInfo) {
+	var list func(fi FileInfo)
+	list = func(fi FileInfo) {
+		if listMatches(fi) {
+			entry := listedFile {
+				Path: filepath.ToSlash(fi.Path),
+				Type: "file",
+				Mode: fmt.Sprintf("%04o", fi.Mode.Perm()),
+				Size: fi.Size,
+				ModTime: fi.ModTime,
+				Target: fi.Target,
+			}
+			if fi.IsDir {
+				entry.Type = "dir"
+			} else if fi.IsLink() {
+				entry.Type = "link"
+			}
+
+			data, err := json.Marshal(entry)
+			checkError(err)
+			fmt.Println(string(data))
+		}
+
+		for _, child := range(contents[fi.Path]) {
+			list(child)
+		}
+	}
+
+	// Like the text listing, a folder's contents are listed, not the folder.
+	if !top.IsDir {
+		list(*top)
+	}
+	for _, child := range(contents[top.Path]) {
+		list(child)
+	}
+}
+
+// Downloads a single file from the server, to the same path under the root.
+func runGet(connectUri, path string) {
+	runCommand(func() {
+		if !validPath(path) {
+			logError("Invalid path", path)
+			os.Exit(1)
+		}
+
+		conn := connect(withPort(connectUri))
+		defer disconnect(conn)
+
+		abs := filepath.Join(rootDir, path)
+		checkError(os.MkdirAll(filepath.Dir(abs), os.ModeDir | 0755))
+
+		logInfo("Requesting", path, "from server.")
+		checkError(send(conn, FileRequest { Path: path }))
+		yes, err := expectBool(conn)
+		checkError(err)
+		if !yes {
+			logError("Server refused to provide", path)
+			os.Exit(1)
+		}
+
+		checkError(recvFile(conn, FileInfo { Path: path }, abs, true, extensions))
+	})
+}
+
+// Uploads a single file (or folder, or link) under the root to the server, at
+// the same path.
+func runPut(connectUri, path string) {
+	runCommand(func() {
+		if !validPath(path) {
+			logError("Invalid path", path)
+			os.Exit(1)
+		}
+
+		abs := filepath.Join(rootDir, path)
+		info, err := os.Lstat(abs)
+		checkError(err)
+
+		conn := connect(withPort(connectUri))
+		defer disconnect(conn)
+
+		// Offer the folders that the file is in first, so that the server
+		// has them; it ignores those that it already has.
+		parts := splitPath(filepath.Clean(path))
+		for i := 1; i < len(parts); i++ {
+			dir := filepath.Join(parts[:i]...)
+			dirInfo, err := os.Lstat(filepath.Join(rootDir, dir))
+			checkError(err)
+			dirFi, err := fileInfo(rootDir, filepath.Join(rootDir, dir), dirInfo)
+			checkError(err)
+			offerAndSend(conn, rootDir, dirFi)
+		}
+
+		fi, err := fileInfo(rootDir, abs, info)
+		checkError(err)
+
+		if !offerAndSend(conn, rootDir, fi) && !fi.IsDir && !fi.IsLink() {
+			logError("Server refused to accept", path)
+			os.Exit(1)
+		}
+	})
+}
+
+// Shows what synchronizing with the server would do, without doing it.
+func runStatus(connectUri string) {
+	runCommand(func() {
+		conn := connect(withPort(connectUri))
+		defer disconnect(conn)
+
+		changes := 0
+		show := func(action syncAction, path string) {
+			var what string
+			switch action {
+			case actionNone:
+				return
+			case actionSend:
+				what = "send     " + path
+			case actionReceive:
+				what = "receive  " + path
+			case actionDeleteTheirs:
+				what = "delete   " + path + " (on the server)"
+			case actionDeleteMine:
+				what = "delete   " + path + " (locally)"
+			case actionAsk:
+				what = "ask      " + path
+			case actionTreeConflict:
+				what = "conflict " + path + " (folder on one side, file on the other)"
+			case actionUnresolved:
+				what = "conflict " + path + " (mod times match)"
+			}
+			fmt.Println(what)
+			changes++
+		}
+
+		// Walk both sides in the same way as the synchronization itself.
+		scopeEnumeration(conn)
+		comparePaths(conn, rootDir, "", func(path string, mine, theirs *FileInfo) {
+			show(chooseAction(mine, theirs), path)
+		})
+
+		if changes == 0 {
+			logInfo("Up to date.")
+		}
+	})
+}
+
+// Compares the client's files with the server's like diff -r, without
+// transferring anything: prints each path that differs, that the server is
+// missing, or that only the server has (extra), and exits with status 1 if
+// there are any (or 2 if they can't be compared).
+func runVerify(connectUri string) {
+	runCommand(func() {
+		conn := connect(withPort(connectUri))
+		defer disconnect(conn)
+
+		differences := 0
+		scopeEnumeration(conn)
+		comparePaths(conn, rootDir, "", func(path string, mine, theirs *FileInfo) {
+			if what := describeDifference(conn, path, mine, theirs); what != "" {
+				fmt.Println(what)
+				differences++
+			}
+		})
+
+		if differences > 0 {
+			logError(differences, "differences found.")
+			disconnect(conn)
+			os.Exit(1)
+		}
+		logInfo("No differences.")
+	})
+}
+
+// Describes how the client's and the server's versions of a path (nil if they
+// don't have one) differ, or returns "" if they match. Files match if their
+// sizes and mod times do, or with --hash, if their contents do.
+func describeDifference(conn net.Conn, path string, mine, theirs *FileInfo) string {
+	why := ""
+	switch {
+	case theirs == nil:
+		return "missing  " + path + " (not on the server)"
+	case mine == nil:
+		return "extra    " + path + " (only on the server)"
+	case mine.IsDir != theirs.IsDir:
+		why = "folder on one side, file on the other"
+	case mine.IsDir:
+	case mine.IsLink() != theirs.IsLink():
+		why = "link on one side only"
+	case mine.IsLink():
+		if mine.Target != theirs.Target {
+			why = "link targets differ"
+		}
+	case mine.Size != theirs.Size:
+		why = "sizes differ"
+	case hash:
+		mySum, err := fileHash(filepath.Join(rootDir, path))
+		checkError(err)
+		theirSum, ok := requestHash(conn, path)
+		if !ok {
+			why = "server refused a checksum"
+		} else if !bytes.Equal(mySum, theirSum) {
+			why = "contents differ"
+		}
+	case !mine.ModTime.Equal(theirs.ModTime):
+		why = "mod times differ"
+	}
+
+	if why == "" {
+		return ""
+	}
+	return "differs  " + path + " (" + why + ")"
+}
@@ -0,0 +1,348 @@
+package main
+
+import "bufio"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+
+// Reads a configuration file in a small subset of TOML: "[section]" headers
+// and "key = value" pairs, where values are quoted strings, integers, booleans
+// or (single-line) lists of strings, and "#" starts a comment. Calls set for
+// each pair, with the section it is in (or "" before the first header).
+// Errors, whether in the syntax or returned by set, are reported along with
+// the line they are on.
+func readConfig(path string, set func(section, key string, value interface{}) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", path, lineNum, fmt.Sprintf(format, args...))
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				return fail("Invalid section header %s", line)
+			}
+			section = strings.TrimSpace(line[1:len(line) - 1])
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 1 {
+			return fail("Expected key = value, found %s", line)
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		value, err := parseConfigValue(strings.TrimSpace(line[eq + 1:]))
+		if err != nil {
+			return fail("Invalid value for %s: %s", key, err)
+		}
+
+		if err := set(section, key, value); err != nil {
+			return fail("%s", err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Removes a trailing comment from a line, ignoring "#" inside of strings.
+func stripComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case '#':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+func parseConfigValue(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, "\""):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "["):
+		return parseConfigList(s)
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	default:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("expected a string, number or boolean, found %s", s)
+		}
+		return n, nil
+	}
+}
+
+// Parses a list of strings, such as ["a", "b"].
+func parseConfigList(s string) (list []string, err error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated list %s", s)
+	}
+
+	list = []string {}
+	rest := strings.TrimSpace(s[1:len(s) - 1])
+	for rest != "" {
+		// Find the end of the next string, skipping escaped quotes.
+		end := -1
+		if strings.HasPrefix(rest, "\"") {
+			for i := 1; i < len(rest); i++ {
+				if rest[i] == '\\' {
+					i++
+				} else if rest[i] == '"' {
+					end = i + 1
+					break
+				}
+			}
+		}
+		if end < 0 {
+			return nil, fmt.Errorf("expected a list of strings, found %s", s)
+		}
+
+		item, err := strconv.Unquote(rest[:end])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+
+		rest = strings.TrimSpace(rest[end:])
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if rest != "" {
+			return nil, fmt.Errorf("expected a list of strings, found %s", s)
+		}
+	}
+	return
+}
+
+// Helpers to check the types of values passed to a readConfig callback.
+func configString(key string, value interface{}) (string, error) {
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("%s must be a string", key)
+}
+
+func configBool(key string, value interface{}) (bool, error) {
+	if b, ok := value.(bool); ok {
+		return b, nil
+	}
+	return false, fmt.Errorf("%s must be true or false", key)
+}
+
+func configList(key string, value interface{}) ([]string, error) {
+	if list, ok := value.([]string); ok {
+		return list, nil
+	}
+	return nil, fmt.Errorf("%s must be a list of strings", key)
+}
+
+func configCount(key string, value interface{}) (int, error) {
+	if n, ok := value.(int); ok && n >= 0 {
+		return n, nil
+	}
+	return 0, fmt.Errorf("%s must be a positive number or 0", key)
+}
+
+// Server settings. They start out as given by the server's flags, then the
+// config file (if any) overrides them. The config file is read again when the
+// server receives SIGHUP; connections that are already open keep the settings
+// that they started with.
+type Config struct {
+	Listen string
+	MaxConnections int
+
+	// Logging; see log.go.
+	LogLevel string
+	LogFormat string
+	LogFile string
+
+	// Where to write the audit log (see audit.go), if anywhere.
+	AuditLog string
+
+	// Where to serve metrics (see metrics.go), if anywhere.
+	Metrics string
+
+	// The default share, and any named ones.
+	Root *Share
+	Shares map[string]*Share
+
+	// The users that may connect, by name. If there are none, anyone may
+	// connect.
+	Users map[string]*User
+}
+
+var serverConfig *Config
+var serverConfigMu sync.RWMutex
+
+func currentConfig() *Config {
+	serverConfigMu.RLock()
+	defer serverConfigMu.RUnlock()
+	return serverConfig
+}
+
+func setConfig(config *Config) {
+	serverConfigMu.Lock()
+	defer serverConfigMu.Unlock()
+	serverConfig = config
+}
+
+// The settings given by the server's flags.
+func flagConfig() *Config {
+	return &Config {
+		Listen: fmt.Sprintf(":%d", port),
+		LogLevel: logLevel,
+		LogFormat: logFormat,
+		LogFile: logFile,
+		AuditLog: auditLogFile,
+		Metrics: metricsAddr,
+		Root: &Share {
+			Root: rootDir,
+			Restrict: restrict,
+			RestrictAll: restrictAll,
+			ReadOnly: readOnly,
+			DropBox: dropBox,
+			KeepVersions: keepVersions,
+			KeepVersionDays: keepVersionDays,
+			AcceptMetadata: acceptMetadata,
+		},
+		Shares: make(map[string]*Share),
+		Users: make(map[string]*User),
+	}
+}
+
+// Reads and validates the server's config file, on top of the settings given
+// by its flags.
+func loadConfig(path string) (*Config, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	configDir := filepath.Dir(path)
+
+	config := flagConfig()
+	err = readConfig(path, func(section, key string, value interface{}) (err error) {
+		switch {
+		case section == "":
+			switch key {
+			case "listen":
+				config.Listen, err = configString(key, value)
+			case "max-connections":
+				config.MaxConnections, err = configCount(key, value)
+			case "verbose":
+				var debug bool
+				debug, err = configBool(key, value)
+				if err == nil && debug {
+					config.LogLevel = "debug"
+				}
+			case "log-level":
+				config.LogLevel, err = configString(key, value)
+				if _, ok := parseLogLevel(config.LogLevel); err == nil && !ok {
+					err = fmt.Errorf("log-level must be debug, info, warn or error")
+				}
+			case "log-format":
+				config.LogFormat, err = configString(key, value)
+				if err == nil && config.LogFormat != "text" && config.LogFormat != "json" {
+					err = fmt.Errorf("log-format must be text or json")
+				}
+			case "log-file":
+				config.LogFile, err = configString(key, value)
+				if err == nil && config.LogFile != "" && !filepath.IsAbs(config.LogFile) {
+					config.LogFile = filepath.Join(configDir, config.LogFile)
+				}
+			case "metrics":
+				config.Metrics, err = configString(key, value)
+			case "audit-log":
+				config.AuditLog, err = configString(key, value)
+				if err == nil && config.AuditLog != "" && !filepath.IsAbs(config.AuditLog) {
+					config.AuditLog = filepath.Join(configDir, config.AuditLog)
+				}
+			default:
+				err = setShareOption(config.Root, configDir, key, value)
+			}
+		case strings.HasPrefix(section, "share."):
+			name := section[len("share."):]
+			if name == "" || strings.ContainsAny(name, "/\\") {
+				return fmt.Errorf("Invalid share name %q", name)
+			}
+
+			share, ok := config.Shares[name]
+			if !ok {
+				// Named shares keep versions and accept metadata like the
+				// default one does, unless they say otherwise.
+				share = &Share {
+					Name: name,
+					KeepVersions: config.Root.KeepVersions,
+					KeepVersionDays: config.Root.KeepVersionDays,
+					AcceptMetadata: config.Root.AcceptMetadata,
+				}
+				config.Shares[name] = share
+			}
+			err = setShareOption(share, configDir, key, value)
+		case strings.HasPrefix(section, "user."):
+			name := section[len("user."):]
+			user, ok := config.Users[name]
+			if !ok {
+				user = &User { Name: name }
+				config.Users[name] = user
+			}
+
+			switch key {
+			case "token":
+				user.Token, err = configString(key, value)
+				if err == nil && user.Token == "" {
+					err = fmt.Errorf("Token of user %s is empty", name)
+				}
+			case "read", "write", "delete":
+				if user.Access == nil {
+					user.Access = &Access {}
+				}
+				err = setAccessOption(user.Access, key, value)
+			default:
+				err = fmt.Errorf("Unknown option %s", key)
+			}
+		default:
+			err = fmt.Errorf("Unknown section [%s]", section)
+		}
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, share := range(append(config.shareList(), config.Root)) {
+		if err := validateShare(share); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	for name, user := range(config.Users) {
+		if user.Token == "" {
+			return nil, fmt.Errorf("%s: User %s has no token", path, name)
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import "fmt"
+
+// Counts the deletions that a synchronization with --delete would make, before
+// any are made, and refuses to go ahead if there are too many of them (unless
+// --force-delete was specified). Deleting everything because the other node's
+// root is empty (such as when run from the wrong folder) is always refused.
+// With --files-from, listed paths that only one side has count towards the
+// limits like any others.
+func checkDeletions(connectUri, root string) {
+	if !autoDelete || interactive || forceDelete {
+		return
+	}
+
+	logVerbose("Counting files to be deleted.")
+	conn := connect(connectUri)
+	defer disconnect(conn)
+
+	// Walk both sides in the same way as the synchronization itself, counting
+	// the files on each, and those that only one side has.
+	var mine, theirs, onlyMine, onlyTheirs int
+	scopeEnumeration(conn)
+	comparePaths(conn, root, "", func(path string, myFi, theirFi *FileInfo) {
+		switch {
+		case myFi == nil:
+			theirs++
+			onlyTheirs++
+		case theirFi == nil:
+			mine++
+			onlyMine++
+		case path == syncPath:
+			// Both roots (or the folder given by --path); never deleted.
+		default:
+			mine++
+			theirs++
+		}
+	})
+
+	// Files are deleted from whichever side isn't kept.
+	where, count, total := "on the server", onlyTheirs, theirs
+	keptSide, kept := "local", mine
+	if keepWhose == "theirs" {
+		where, count, total = "locally", onlyMine, mine
+		keptSide, kept = "server's", theirs
+	}
+
+	var err error
+	if count > 0 && kept == 0 {
+		err = fmt.Errorf("Refusing to delete all %d files %s; the %s folder is empty.",
+			count, where, keptSide)
+	} else if maxDeletes > 0 && count > maxDeletes {
+		err = fmt.Errorf("Refusing to delete %d files %s; the limit is %d (see --max-delete).",
+			count, where, maxDeletes)
+	} else if maxDeletePercent > 0 && count * 100 > total * maxDeletePercent {
+		err = fmt.Errorf("Refusing to delete %d of %d files %s; the limit is %d%% (see --max-delete-percent).",
+			count, total, where, maxDeletePercent)
+	}
+
+	if err != nil {
+		logError(err)
+		logError("Use --force-delete to delete them anyway.")
+		panic(err)
+	}
+
+	logVerbose(count, "of", total, "files will be deleted", where)
+}
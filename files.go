@@ -1,50 +1,588 @@
 package main
 
+import "crypto/sha256"
 import "fmt"
+import "io"
 import "path/filepath"
 import "os"
+import "regexp"
+import "runtime"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+// How symbolic links are handled when enumerating files.
+type LinkPolicy int
+const (
+	// Follow links, treating them as the file or folder they point to.
+	LinksCopy LinkPolicy = iota
+
+	// Report links as links, to be recreated as such.
+	LinksPreserve
+
+	// Leave links out entirely.
+	LinksSkip
+)
+
+// The symbolic link policy implied by a set of negotiated extensions.
+func linkPolicy(ext Extensions) LinkPolicy {
+	if ext & ExtSkipSymlinks != 0 {
+		return LinksSkip
+	} else if ext & ExtSymlinks != 0 {
+		return LinksPreserve
+	} else {
+		return LinksCopy
+	}
+}
 
 // Recursively navigates the filesystem from the specified root in alphabetical
-// order, returning all files/folders found.
-func enumerateFiles(root string) (<-chan FileInfo) {
+// order, returning all files/folders found. The negotiated extensions decide
+// how links are reported. If confined is set, links that lead outside of the
+// root are never followed, whatever the extensions.
+func enumerateFiles(root string, ext Extensions, confined bool) (<-chan FileInfo) {
+	return enumerateSubtree(root, ".", ext, confined)
+}
+
+// Enumerates files like enumerateFiles, but only those at and under sub (a
+// path relative to the root).
+func enumerateSubtree(root, sub string, ext Extensions, confined bool) (<-chan FileInfo) {
 	out := make(chan FileInfo)
+	dir := filepath.Join(root, sub)
 
 	go func() {
 		defer func() {
 			close(out)
 		}()
 
-		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				// The containing folder may have been deleted already; skip
-				// this. Log a warning for any other error.
-				if !os.IsNotExist(err) {
-					fmt.Fprintln(os.Stderr, "WARNING:", err)
-				}
+		w := walker {
+			links: linkPolicy(ext),
+			hardLinks: ext & ExtHardLinks != 0,
+			visiting: make(map[string]bool),
+			inodes: make(map[fileID]string),
+			out: out,
+		}
+
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			w.visiting[resolved] = true
+		}
+		if confined {
+			w.confine = resolvedRoot(root)
+		}
+
+		w.walk(dir, filepath.Clean(sub))
+	}()
+
+	return out
+}
+
+// Identifies a file (rather than a path to it) on a particular device.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// State of an enumeration.
+type walker struct {
+	links LinkPolicy
+	hardLinks bool
+
+	// Folders that are being walked (by their resolved paths), so that
+	// following links can't loop forever.
+	visiting map[string]bool
+
+	// The first path seen for each file with more than one hard link.
+	inodes map[fileID]string
+
+	// If set, the resolved root that links mustn't lead outside of.
+	confine string
+
+	out chan<- FileInfo
+}
+
+// Walks the folder at dir, reporting everything in it as being under the
+// relative path rel.
+func (w *walker) walk(dir, rel string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The containing folder may have been deleted already; skip
+			// this. Log a warning for any other error.
+			if !os.IsNotExist(err) {
+				logWarning(err)
+			}
+			return nil
+		}
+
+		// Files that are still being received aren't ready to be synced.
+		if tempRx.MatchString(info.Name()) {
+			return nil
+		}
+
+		// Zync's own folder is never synced.
+		if sub, _ := filepath.Rel(dir, path); filepath.Join(rel, sub) == metaDir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.Mode() & os.ModeSymlink != 0 && path != dir {
+			switch w.links {
+			case LinksSkip:
 				return nil
-			} else {
-				fi, err := fileInfo(root, path, info)
-				if err == nil {
-					out <- fi
+			case LinksCopy:
+				target, err := os.Stat(path)
+				if err != nil {
+					logWarning("Skipping broken link:", err)
+					return nil
+				} else if w.confine != "" && !leadsWithin(w.confine, path) {
+					logWarning("Skipping link that leads outside of the root:", path)
+					return nil
+				}
+
+				if target.IsDir() {
+					resolved, err := filepath.EvalSymlinks(path)
+					if err != nil || w.visiting[resolved] {
+						logWarning("Skipping link to", resolved, "(loop)")
+						return nil
+					}
+
+					sub, _ := filepath.Rel(dir, path)
+					w.visiting[resolved] = true
+					w.walk(resolved, filepath.Join(rel, sub))
+					delete(w.visiting, resolved)
+					return nil
+				}
+
+				info = target
+			}
+		}
+
+		fi, err := fileInfo(dir, path, info)
+		if err != nil {
+			return err
+		}
+		fi.Path = filepath.Join(rel, fi.Path)
+
+		// Files with several hard links are reported in full the first time,
+		// and as links to that first path after that.
+		if w.hardLinks && info.Mode().IsRegular() {
+			if id, ok := hardLinkID(info); ok {
+				if first, seen := w.inodes[id]; seen {
+					fi.LinkTo = first
+				} else {
+					w.inodes[id] = fi.Path
 				}
-				return err
 			}
-		})
+		}
+
+		w.out <- fi
+		return nil
+	})
+}
+
+// Enumerates files at and under sub like enumerateSubtree, but skips all files
+// up to and including the specified path. If the path is empty, nothing is
+// skipped.
+func enumerateFilesAfter(root, sub, after string, ext Extensions, confined bool) (<-chan FileInfo) {
+	files := enumerateSubtree(root, sub, ext, confined)
+	if after == "" {
+		return files
+	}
+
+	out := make(chan FileInfo)
+	go func() {
+		defer close(out)
+
+		for fi := range(files) {
+			if pathBefore(after, fi.Path) {
+				out <- fi
+			}
+		}
 	}()
 
 	return out
 }
 
+// Looks up a single path (relative to the root) without walking anything,
+// returning what the enumeration would report for it. Returns false if the
+// enumeration would leave it out, such as when it doesn't exist.
+func statFile(root, path string, ext Extensions, confined bool) (fi FileInfo, ok bool) {
+	if tempRx.MatchString(filepath.Base(path)) {
+		return
+	}
+
+	abs := filepath.Join(root, path)
+	info, err := os.Lstat(abs)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logWarning(err)
+		}
+		return
+	}
+
+	if info.Mode() & os.ModeSymlink != 0 {
+		switch linkPolicy(ext) {
+		case LinksSkip:
+			return
+		case LinksCopy:
+			target, err := os.Stat(abs)
+			if err != nil {
+				logWarning("Skipping broken link:", err)
+				return
+			} else if confined && !leadsWithin(resolvedRoot(root), abs) {
+				logWarning("Skipping link that leads outside of the root:", abs)
+				return
+			}
+			info = target
+		}
+	}
+
+	fi, err = fileInfo(root, abs, info)
+	if err != nil {
+		logWarning(err)
+		return
+	}
+	return fi, true
+}
+
+// The root with any links in it resolved, or the root as given if that fails.
+func resolvedRoot(root string) string {
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		return resolved
+	}
+	return root
+}
+
+// Whether a path (such as a link) leads to somewhere within the resolved root,
+// other than Zync's own folder.
+func leadsWithin(resolvedRoot, path string) bool {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	return err == nil && validPath(rel)
+}
+
+// Whether path a comes before path b in the order that files are enumerated
+// in: each folder (starting with the root, ".") is followed by its contents,
+// in alphabetical order.
+func pathBefore(a, b string) bool {
+	as, bs := splitPath(a), splitPath(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+
+	return len(as) < len(bs)
+}
+
+// Splits a relative path into its components. The root itself has none.
+func splitPath(path string) []string {
+	if path == "." || path == "" {
+		return nil
+	}
+
+	return strings.Split(path, string(filepath.Separator))
+}
+
 func fileInfo(root string, path string, info os.FileInfo) (fi FileInfo, err error) {
-	path, err = filepath.Rel(root, path)
+	fi.Path, err = filepath.Rel(root, path)
 	if err != nil {
 		return
 	}
 
-	fi.Path = path
 	fi.IsDir = info.IsDir()
 	fi.Mode = info.Mode()
 	fi.ModTime = info.ModTime()
 	fi.Size = info.Size()
+
+	if info.Mode() & os.ModeSymlink != 0 {
+		fi.Target, err = os.Readlink(path)
+	}
+	return
+}
+
+// Folders that were created or written into during a synchronization, whose
+// modification times (and, for those that were created, permissions) are
+// applied once everything in them has been written.
+type dirFixups struct {
+	mu sync.Mutex
+	dirs map[string]dirFixup
+
+	// The sender's versions of folders that both nodes have, in case anything
+	// is written into them.
+	shared map[string]FileInfo
+}
+
+type dirFixup struct {
+	info FileInfo
+	created bool
+}
+
+// Records a folder to fix up, as the sender has it. Called with the lock held.
+func (fixups *dirFixups) add(fi FileInfo, created bool) {
+	if fixups.dirs == nil {
+		fixups.dirs = make(map[string]dirFixup)
+	}
+	fixup := fixups.dirs[fi.Path]
+	fixups.dirs[fi.Path] = dirFixup { fi, created || fixup.created }
+}
+
+// Creates the folder described by fi under root, along with any missing
+// parents. If the folder already exists, only its modification time is fixed
+// up. The folder is writable by its owner until the fixups are applied.
+func (fixups *dirFixups) makeDir(root string, fi FileInfo) (err error) {
+	path := filepath.Join(root, fi.Path)
+
+	created := false
+	info, err := os.Stat(path)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("Cannot create folder %s; a file is in the way.", path)
+		}
+	} else if err = os.MkdirAll(path, os.ModeDir | 0700); err != nil {
+		return
+	} else {
+		created = true
+	}
+
+	fixups.mu.Lock()
+	defer fixups.mu.Unlock()
+	fixups.add(fi, created)
 	return
 }
+
+// Notes the sender's version of a folder that both nodes have, so that its
+// modification time is restored if anything is written into it.
+func (fixups *dirFixups) saw(fi FileInfo) {
+	fixups.mu.Lock()
+	defer fixups.mu.Unlock()
+
+	if fixups.shared == nil {
+		fixups.shared = make(map[string]FileInfo)
+	}
+	fixups.shared[fi.Path] = fi
+}
+
+// Called before a path is written, so that the folder it is in has its
+// modification time restored afterwards.
+func (fixups *dirFixups) writing(path string) {
+	fixups.mu.Lock()
+	defer fixups.mu.Unlock()
+
+	dir := filepath.Dir(path)
+	if fi, ok := fixups.shared[dir]; ok {
+		delete(fixups.shared, dir)
+		fixups.add(fi, false)
+	}
+}
+
+// Applies the permissions and modification times of all folders recorded so
+// far, deepest first.
+func (fixups *dirFixups) apply(root string) {
+	fixups.mu.Lock()
+	defer fixups.mu.Unlock()
+
+	var dirs []dirFixup
+	for _, fixup := range(fixups.dirs) {
+		dirs = append(dirs, fixup)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(splitPath(dirs[i].info.Path)) > len(splitPath(dirs[j].info.Path))
+	})
+
+	for _, fixup := range(dirs) {
+		fi := fixup.info
+		path := filepath.Join(root, fi.Path)
+
+		if fixup.created {
+			if err := os.Chmod(path, fi.Mode.Perm()); err != nil {
+				logWarning("Failed to set mode of", fi.Path, err)
+			}
+		}
+		if err := os.Chtimes(path, fi.ModTime, fi.ModTime); err != nil {
+			logWarning("Failed to set modification time of", fi.Path, err)
+		}
+	}
+
+	fixups.dirs = nil
+	fixups.shared = nil
+}
+
+// Whether a link's target lies outside of the root that the link is in.
+// Absolute targets are always considered to escape.
+func linkEscapes(fi FileInfo) bool {
+	if filepath.IsAbs(fi.Target) {
+		return true
+	}
+
+	return pathEscapes(filepath.Join(filepath.Dir(fi.Path), fi.Target))
+}
+
+// Whether a link at a path under root would lead outside of the root (or into
+// Zync's own folder), once any links in the folders that it is in, and those
+// in its target, are resolved. Absolute targets are always considered to.
+func linkLeadsOut(root string, fi FileInfo) bool {
+	if filepath.IsAbs(fi.Target) {
+		return true
+	}
+
+	parent, ok := resolveParent(root, fi.Path)
+	if !ok {
+		return true
+	}
+	dir := filepath.Dir(parent)
+	if pathEscapes(filepath.Join(dir, fi.Target)) {
+		return true
+	}
+
+	// Links in the target itself are followed before any ".." after them, so
+	// check where it actually leads, if it leads anywhere yet.
+	resolved := resolvedRoot(root)
+	target := filepath.Join(resolved, dir) + string(filepath.Separator) + fi.Target
+	if _, err := filepath.EvalSymlinks(target); err != nil {
+		return false
+	}
+	return !leadsWithin(resolved, target)
+}
+
+// Whether a path that should be relative to a root lies outside of it.
+func pathEscapes(path string) bool {
+	path = filepath.Clean(path)
+	return filepath.IsAbs(path) || path == ".." ||
+		strings.HasPrefix(path, ".." + string(filepath.Separator))
+}
+
+// Creates a symbolic link described by fi under root, replacing whatever is
+// at that path if overwrite is set.
+func createSymlink(root string, fi FileInfo, overwrite bool) (err error) {
+	path := filepath.Join(root, fi.Path)
+
+	if !overwrite {
+		if _, err = os.Lstat(path); !os.IsNotExist(err) {
+			return fmt.Errorf("Refusing to overwrite %s.", path)
+		}
+	}
+
+	// Create the link under a temporary name, then move it into place.
+	temp := tempName(path)
+	err = os.Symlink(fi.Target, temp)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(temp, path)
+	if err != nil {
+		os.Remove(temp)
+	}
+	return
+}
+
+// Recreates fi under root as a hard link, if it is one and the file that it
+// links to is already in place. Returns whether it did.
+func restoreHardLink(root string, fi FileInfo) bool {
+	if fi.LinkTo == "" || pathEscapes(fi.LinkTo) {
+		return false
+	}
+
+	ok, err := createHardLink(root, fi)
+	checkError(err)
+
+	if ok {
+		logVerbose("Linking", fi.Path, "to", fi.LinkTo)
+	}
+	return ok
+}
+
+// Creates a hard link at fi.Path to fi.LinkTo (both under root), replacing
+// whatever is at that path. Does nothing and returns false if the file at
+// fi.LinkTo doesn't match fi, in which case the file should be transferred
+// instead.
+func createHardLink(root string, fi FileInfo) (ok bool, err error) {
+	path := filepath.Join(root, fi.Path)
+	existing := filepath.Join(root, fi.LinkTo)
+
+	info, err := os.Lstat(existing)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != fi.Size || !info.ModTime().Equal(fi.ModTime) {
+		return false, nil
+	}
+
+	if current, err := os.Lstat(path); err == nil && os.SameFile(info, current) {
+		return true, nil
+	}
+
+	temp := tempName(path)
+	err = os.Link(existing, temp)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(temp, path)
+	if err != nil {
+		os.Remove(temp)
+		return
+	}
+
+	return true, nil
+}
+
+// Temp files are named with a hidden prefix that identifies them as Zync's,
+// so that they are left out when enumerating files and can be cleaned up if
+// they are left behind.
+var tempRx = regexp.MustCompile("^\\.zync-\\d+-")
+
+// A hidden, unique name in the same folder as path, for creating a file that
+// is then renamed to path.
+func tempName(path string) string {
+	return filepath.Join(filepath.Dir(path),
+		fmt.Sprintf(".zync-%d-%s", time.Now().UnixNano(), filepath.Base(path)))
+}
+
+// Removes any temp files left behind under root by an earlier run that was
+// interrupted.
+func removeTempFiles(root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && tempRx.MatchString(info.Name()) {
+			logVerbose("Removing stale temp file", path)
+			if err := os.Remove(path); err != nil {
+				logWarning(err)
+			}
+		}
+		return nil
+	})
+}
+
+// Computes a SHA-256 checksum of a file's contents.
+func fileHash(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Flushes a folder to disk, so that files that were just created or renamed
+// in it stay that way.
+func syncDir(path string) error {
+	// Folders can't be synced on Windows; renames are durable there anyway.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
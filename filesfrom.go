@@ -0,0 +1,111 @@
+package main
+
+import "bufio"
+import "fmt"
+import "io"
+import "net"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+
+// Paths read from --files-from, in the order that files are enumerated in.
+var listedPaths []string
+
+// Reads the paths to synchronize from a file (or standard input, if it is
+// "-"), one per line and relative to the root. Blank lines and lines starting
+// with # are ignored.
+func readFileList(name string) ([]string, error) {
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	seen := make(map[string]bool)
+	var paths []string
+	scanner := bufio.NewScanner(in)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		path := filepath.Clean(filepath.FromSlash(line))
+		if !validPath(path) || filepath.IsAbs(path) {
+			return nil, fmt.Errorf("%s:%d: Invalid path %s", name, lineNum, line)
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		return pathBefore(paths[i], paths[j])
+	})
+	return paths, nil
+}
+
+// Looks up each listed path after the specified one (or every listed path, if
+// it is empty) on both nodes, instead of enumerating everything, and calls
+// visit with each node's version of it (nil if it doesn't have one).
+func compareListedPaths(conn net.Conn, root, after string, visit func(path string, mine, theirs *FileInfo)) {
+	for _, path := range(listedPaths) {
+		if after != "" && !pathBefore(after, path) {
+			continue
+		}
+
+		mine, myOk := statFile(root, path, extensions, false)
+		theirs, svrOk := requestFileInfo(conn, path)
+		switch {
+		case myOk && svrOk:
+			visit(path, &mine, &theirs)
+		case myOk:
+			visit(path, &mine, nil)
+		case svrOk:
+			visit(path, nil, &theirs)
+		default:
+			logVerbose("Neither node has", path)
+		}
+	}
+}
+
+// The folders that a listed path is in aren't compared themselves, so before
+// the path is sent to the server, any of them that the server doesn't have are
+// offered first.
+func sendParents(conn net.Conn, root, path string) {
+	parts := splitPath(path)
+	for i := 1; i < len(parts); i++ {
+		dir := filepath.Join(parts[:i]...)
+		if _, ok := requestFileInfo(conn, dir); ok {
+			continue
+		}
+		if fi, ok := statFile(root, dir, extensions, false); ok && fi.IsDir {
+			offerAndSend(conn, root, fi)
+		}
+	}
+}
+
+// Likewise, creates any of the folders that a listed path is in that the
+// client doesn't have before it is received.
+func receiveParents(conn net.Conn, root, path string) {
+	parts := splitPath(path)
+	for i := 1; i < len(parts); i++ {
+		dir := filepath.Join(parts[:i]...)
+		if _, ok := statFile(root, dir, extensions, false); ok {
+			continue
+		}
+		if fi, ok := requestFileInfo(conn, dir); ok && fi.IsDir {
+			logVerbose("Creating folder", fi.Path)
+			checkError(createdDirs.makeDir(root, fi))
+		}
+	}
+}
@@ -1,30 +1,171 @@
 package main
 
+import "encoding/json"
 import "fmt"
 import "io"
 import "os"
+import "strings"
+import "sync"
+import "time"
 
-func log(out io.Writer, prefix string, args ...interface{}) {
-	if prefix != "" {
-		args = append([]interface{} { prefix }, args...)
+// Severity of a log message. Messages below the configured level are dropped.
+type LogLevel int
+const (
+	// Details of everything that happens; shown with --verbose (-v).
+	LevelDebug LogLevel = iota
+
+	// What is being done, such as files being transferred.
+	LevelInfo
+
+	// Something went wrong, but work carries on.
+	LevelWarning
+
+	// Work has to stop.
+	LevelError
+)
+
+var LogLevelNames = map[LogLevel]string {
+	LevelDebug: "debug",
+	LevelInfo: "info",
+	LevelWarning: "warn",
+	LevelError: "error",
+}
+
+func parseLogLevel(name string) (LogLevel, bool) {
+	for level, levelName := range(LogLevelNames) {
+		if levelName == name {
+			return level, true
+		}
+	}
+	return LevelInfo, false
+}
+
+// Where and how log messages are written. By default, debug and info messages
+// go to stdout and the rest to stderr; with a log file, they all go there.
+type logger struct {
+	mu sync.Mutex
+	level LogLevel
+	json bool
+	path string
+	file *os.File
+}
+
+var logs = logger { level: LevelInfo }
+
+// Changes the level, format ("text" or "json") and file (or "" for the
+// standard streams) of the log.
+func (l *logger) configure(level LogLevel, format, path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if format != "text" && format != "json" {
+		return fmt.Errorf("Unknown log format %s", format)
+	}
+
+	if path != l.path {
+		var file *os.File
+		if path != "" {
+			var err error
+			file, err = os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+			if err != nil {
+				return err
+			}
+		}
+
+		if l.file != nil {
+			l.file.Close()
+		}
+		l.path, l.file = path, file
+	}
+
+	l.level = level
+	l.json = format == "json"
+	return nil
+}
+
+// Sets up the log from the --log-level, --log-format and --log-file options or
+// their config file equivalents. An empty level means info.
+func configureLogs(levelName, format, path string) error {
+	level := LevelInfo
+	if levelName != "" {
+		var ok bool
+		level, ok = parseLogLevel(levelName)
+		if !ok {
+			return fmt.Errorf("Unknown log level %s; expected debug, info, warn or error", levelName)
+		}
 	}
-	fmt.Fprintln(out, args...)
+	return logs.configure(level, format, path)
+}
+
+// Writes a message, made of args as if by fmt.Println. Messages about a
+// particular server session are tagged with its ID; others pass 0.
+func (l *logger) write(level LogLevel, sessionID uint64, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	var out io.Writer = os.Stdout
+	if l.file != nil {
+		out = l.file
+	} else if level >= LevelWarning {
+		out = os.Stderr
+	}
+
+	now := time.Now()
+	msg := strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+	if l.json {
+		entry := struct {
+			Time time.Time `json:"time"`
+			Level string `json:"level"`
+			Session uint64 `json:"session,omitempty"`
+			Message string `json:"msg"`
+		} { now.UTC(), LogLevelNames[level], sessionID, msg }
+
+		data, _ := json.Marshal(entry)
+		fmt.Fprintln(out, string(data))
+		return
+	}
+
+	prefix := fmt.Sprintf("%s %-5s", now.Format("2006-01-02 15:04:05.000"), strings.ToUpper(LogLevelNames[level]))
+	if sessionID != 0 {
+		prefix = fmt.Sprintf("%s [#%d]", prefix, sessionID)
+	}
+	fmt.Fprintln(out, prefix, msg)
 }
 
 func logError(args ...interface{}) {
-	log(os.Stderr, "ERROR:", args...)
+	logs.write(LevelError, 0, args)
 }
 
 func logInfo(args ...interface{}) {
-	log(os.Stdout, "", args...)
+	logs.write(LevelInfo, 0, args)
 }
 
+// Logs at the debug level.
 func logVerbose(args ...interface{}) {
-	if verbose {
-		log(os.Stdout, "", args...)
-	}
+	logs.write(LevelDebug, 0, args)
 }
 
 func logWarning(args ...interface{}) {
-	log(os.Stderr, "WARNING:", args...)
+	logs.write(LevelWarning, 0, args)
+}
+
+// Logging for a particular server session, tagged with its ID.
+func (s *session) logError(args ...interface{}) {
+	logs.write(LevelError, s.id, args)
+}
+
+func (s *session) logInfo(args ...interface{}) {
+	logs.write(LevelInfo, s.id, args)
+}
+
+func (s *session) logVerbose(args ...interface{}) {
+	logs.write(LevelDebug, s.id, args)
+}
+
+func (s *session) logWarning(args ...interface{}) {
+	logs.write(LevelWarning, s.id, args)
 }
@@ -2,73 +2,251 @@ package main
 
 import "fmt"
 import "os"
-import "strconv"
+import "path/filepath"
+import "strings"
 
 func main() {
-	args := os.Args
+	var server, help bool
+	var connectUri string
+	opts := []*option {
+		flagOption(&help, modeAny, "help", "h", "Shows this help."),
+		flagOption(&server, modeServer, "server", "s", "Runs the node in server mode."),
+		stringOption(&connectUri, modeClient, "connect", "c", "remote", "Connects to the specified server."),
 
-	// Determine the run mode.
-	server, args := argFlag(args, "server", "s")
-	client, connectUri, args := argOption(args, "connect", "c")
+		// Global options.
+		flagOption(&verbose, modeAny, "verbose", "v", "Logs every file event; same as --log-level debug."),
+		choiceOption(&logLevel, modeAny, "log-level", "", "Only logs messages at or above this level.", "debug", "info", "warn", "error"),
+		choiceOption(&logFormat, modeAny, "log-format", "", "Logs as timestamped lines of text, or JSON objects.", "text", "json"),
+		stringOption(&logFile, modeAny, "log-file", "", "file", "Appends log messages to the file."),
+		stringOption(&rootDir, modeAny, "root", "", "folder", "Synchronizes the folder instead of the working directory."),
+		flagOption(&hash, modeAny, "hash", "", "With --verify, compares checksums of files."),
+		flagOption(&noTrash, modeAny, "no-trash", "", "Deletes files outright instead of moving them to the trash."),
+		intOption(&trashDays, modeAny, "trash-days", "", "number", "Days to keep files in the trash; 0 to keep them.", 0, -1),
 
-	if server && client {
-		fmt.Fprintln(os.Stderr, "Only one of --connect (-c), --server (-s) can be specified.")
-		os.Exit(1)
+		// Server options.
+		intOption(&port, modeServer, "port", "p", "number", "Listens on the port.", 0, 65535),
+		flagOption(&restrict, modeServer, "restrict", "r", "Refuses to delete files."),
+		flagOption(&restrictAll, modeServer, "Restrict", "R", "Refuses to delete or overwrite files."),
+		flagOption(&readOnly, modeServer, "read-only", "", "Refuses all changes from clients."),
+		flagOption(&dropBox, modeServer, "drop-box", "", "Only accepts new files, and lists none."),
+		stringOption(&configFile, modeServer, "config", "", "file", "Reads settings from the config file."),
+		stringOption(&auditLogFile, modeServer, "audit-log", "", "file", "Records what clients do in the file."),
+		stringOption(&metricsAddr, modeServer, "metrics", "", "address", "Serves Prometheus metrics at the address."),
+		intOption(&shutdownTimeout, modeServer, "shutdown-timeout", "", "seconds", "Time to let clients finish when stopping.", 0, -1),
+		intOption(&keepVersions, modeServer, "keep-versions", "", "number", "Keeps versions of replaced or deleted files.", 0, -1),
+		intOption(&keepVersionDays, modeServer, "keep-days", "", "number", "Keeps versions for the number of days.", 0, -1),
+		newOption(modeServer, "accept-metadata", "", "list", "Applies clients' owner, xattrs and/or acls, comma-separated.", func(value string) (err error) {
+			acceptMetadata, err = parseAcceptedMetadata(strings.Split(value, ","))
+			return
+		}),
+
+		// Client options.
+		stringOption(&syncPath, modeClient, "path", "", "path", "Only synchronizes the files at and under the path."),
+		stringOption(&filesFrom, modeClient, "files-from", "", "file", "Only synchronizes the paths listed in the file; - for stdin."),
+		choiceOption(&keepWhose, modeClient, "keep", "k", "Resolves conflicts by keeping these files.", "theirs", "mine"),
+		flagOption(&interactive, modeClient, "interactive", "i", "Asks what to do about each conflict."),
+		flagOption(&autoDelete, modeClient, "delete", "d", "Deletes files that the kept node doesn't have."),
+		flagOption(&forceDelete, modeClient, "force-delete", "", "Deletes files beyond the limits below."),
+		intOption(&maxDeletes, modeClient, "max-delete", "", "number", "The most files to delete; 0 for no limit.", 0, -1),
+		intOption(&maxDeletePercent, modeClient, "max-delete-percent", "", "number", "The largest share of files to delete.", 0, 100),
+		flagOption(&reverse, modeClient, "reverse", "", "Has no effect; reserved."),
+		intOption(&jobs, modeClient, "jobs", "j", "number", "Transfers up to this many files at once.", 1, -1),
+		intOption(&retries, modeClient, "retries", "", "number", "Reconnects up to this many times.", 0, -1),
+		flagOption(&preserveMode, modeClient, "perms", "", "Applies permission bits."),
+		flagOption(&preserveOwner, modeClient, "owner", "", "Applies owners and groups."),
+		flagOption(&numericIds, modeClient, "numeric-ids", "", "Matches owners by numeric ID."),
+		flagOption(&preserveXattrs, modeClient, "xattrs", "", "Copies extended attributes."),
+		flagOption(&preserveACLs, modeClient, "acls", "", "Copies POSIX ACLs."),
+		choiceOption(&links, modeClient, "links", "", "How symbolic links are handled.", "copy", "preserve", "skip"),
+		flagOption(&safeLinks, modeClient, "safe-links", "", "Refuses links that point outside of the root."),
+		flagOption(&hardLinks, modeClient, "hard-links", "", "Recreates hard links."),
+		stringOption(&userName, modeClient, "user", "", "name", "Logs in as the user."),
+		stringOption(&tokenFile, modeClient, "token-file", "", "file", "Reads the user's token from the file."),
+		stringOption(&listVersionsOf, modeClient, "list-versions", "", "path", "Lists the server's versions of the file."),
+		stringOption(&restorePath, modeClient, "restore", "", "path", "Restores a version of the file on the server."),
+		stringOption(&restoreVersionId, modeClient, "version", "", "version", "The version to restore."),
+		flagOption(&verify, modeClient, "verify", "", "Only compares with the server; exits 1 on differences, 2 on errors."),
+		stringOption(&listGlob, modeClient, "glob", "", "pattern", "With ls, only lists entries whose names match."),
+		flagOption(&listJSON, modeClient, "json", "", "With ls, lists entries as JSON objects."),
 	}
 
-	// Global options.
-	hash, args = argFlag(args, "hash", "h")
-	verbose, args = argFlag(args, "verbose", "v")
+	for _, opt := range(opts) {
+		switch opt.long {
+		case "server", "connect":
+			opt.selectsMode = true
+			opt.env = ""
+		case "help", "path", "files-from", "list-versions", "restore", "version":
+			// One-off commands make no sense as defaults.
+			opt.env = ""
+		case "Restrict":
+			opt.env = "ZYNC_RESTRICT_ALL"
+		}
+	}
 
-	if server {
-		// Server mode.
-		portSpecified, portStr, _ := argOption(args, "port", "p")
-		if portSpecified {
-			portNum, err := strconv.ParseInt(portStr, 10, 0)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Port must be a number")
-				os.Exit(1)
+	command, mode, rest, err := parseArgs(opts, os.Args[1:])
+	if help {
+		usage(os.Stdout, opts)
+		return
+	}
+	if err == nil && command == "" {
+		// The old --server and --connect flags stand for serve and sync.
+		switch mode {
+		case modeServer:
+			command = "serve"
+		case modeClient:
+			if connectUri == "" {
+				err = fmt.Errorf("--connect (-c) requires a URI.")
 			}
-			port = int(portNum)
+			command, rest = "sync", append([]string { connectUri }, rest...)
+		default:
+			err = fmt.Errorf("Expected a command, such as zync sync {remote}.")
 		}
+	}
+
+	// Each command takes a remote (except serve), then a path for get and put.
+	wantArgs := map[string]int { "serve": 0, "get": 2, "put": 2 }
+	want, ok := wantArgs[command]
+	if !ok {
+		want = 1
+	}
+	if verify {
+		errorStatus = 2
+	}
+	if err == nil && len(rest) > want {
+		err = fmt.Errorf("Unexpected argument %s.", rest[want])
+	} else if err == nil && len(rest) < want {
+		err = fmt.Errorf("zync %s requires %d arguments.", command, want)
+	}
+	if err != nil {
+		usageError(err)
+	}
+
+	if logLevel == "" && verbose {
+		logLevel = "debug"
+	}
+	if err := configureLogs(logLevel, logFormat, logFile); err != nil {
+		usageError(err)
+	}
 
-		restrict, args = argFlag(args, "restrict", "r")
-		restrictAll, args = argFlag(args, "Restrict", "R")
+	if rootDir == "" {
+		wd, err := os.Getwd()
+		checkError(err)
+		rootDir = wd
+	} else if abs, err := filepath.Abs(rootDir); err != nil {
+		usageError(err)
+	} else if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+		usageError(fmt.Errorf("--root must be an existing folder."))
+	} else {
+		rootDir = abs
+	}
+
+	if mode == modeServer {
+		if readOnly && dropBox {
+			usageError(fmt.Errorf("Only one of --read-only, --drop-box can be specified."))
+		}
 
 		runServer()
-	} else if client {
-		// Client mode.
-		if connectUri == "" {
-			fmt.Fprintln(os.Stderr, "--connect (-c) requires a URI.")
-			os.Exit(1)
+	} else {
+		// A share can be named as {host}[:{port}]/{share}, and ls can be given
+		// a path after it.
+		var path string
+		connectUri, shareName, path = parseRemote(rest[0])
+		switch {
+		case path == "" || command == "ls":
+		case command != "sync" && command != "status":
+			usageError(fmt.Errorf("zync %s doesn't take a path after the remote.", command))
+		case syncPath != ".":
+			usageError(fmt.Errorf("Only one of --path, a path after the remote can be specified."))
+		default:
+			// {remote}:{path} is the same as --path {path}.
+			syncPath = path
 		}
 
-		interactive, args = argFlag(args, "interactive", "i")
+		syncPath = filepath.Clean(syncPath)
+		if !validPath(syncPath) {
+			usageError(fmt.Errorf("--path must be a path under the root, outside of %s.", metaDir))
+		}
+		if syncPath != "." && command != "sync" && command != "status" {
+			usageError(fmt.Errorf("--path can only be used with zync sync and zync status."))
+		}
 
-		_, keepWhose, args = argOption(args, "keep", "k")
-		if keepWhose != "" && keepWhose != "theirs" && keepWhose != "mine" {
-			fmt.Fprintln(os.Stderr, "--keep (-k) must be 'theirs' or 'mine'.")
-			os.Exit(1)
+		if filesFrom != "" && command != "sync" && command != "status" {
+			usageError(fmt.Errorf("--files-from can only be used with zync sync and zync status."))
+		}
+		if filesFrom != "" && syncPath != "." {
+			usageError(fmt.Errorf("Only one of --path, --files-from can be specified."))
+		}
+		if filesFrom == "-" && interactive {
+			usageError(fmt.Errorf("--files-from - can't be used with --interactive (-i), which reads from stdin."))
 		}
 
-		autoDelete, args = argFlag(args, "delete", "d")
 		if autoDelete && keepWhose == "" {
-			fmt.Fprintln(os.Stderr, "--delete (-d) can only be used in combination with --keep (-k).")
-			os.Exit(1)
+			usageError(fmt.Errorf("--delete (-d) can only be used in combination with --keep (-k)."))
+		}
+		if numericIds && !preserveOwner {
+			usageError(fmt.Errorf("--numeric-ids can only be used in combination with --owner."))
+		}
+		if listVersionsOf != "" && restorePath != "" {
+			usageError(fmt.Errorf("Only one of --list-versions, --restore can be specified."))
+		}
+		if restoreVersionId != "" && restorePath == "" {
+			usageError(fmt.Errorf("--version can only be used in combination with --restore."))
+		}
+		if (listGlob != "" || listJSON) && command != "ls" {
+			usageError(fmt.Errorf("--glob and --json can only be used with zync ls."))
+		}
+		if _, err := filepath.Match(listGlob, ""); err != nil {
+			usageError(fmt.Errorf("--glob: %s", err))
+		}
+		if verify && command != "sync" {
+			usageError(fmt.Errorf("--verify can only be used with zync sync."))
+		}
+		if (listVersionsOf != "" || restorePath != "") && command != "sync" {
+			usageError(fmt.Errorf("--list-versions and --restore can't be used with zync %s.", command))
 		}
 
-		reverse, args = argFlag(args, "reverse", "r")
+		if filesFrom != "" {
+			paths, err := readFileList(filesFrom)
+			if err != nil {
+				usageError(fmt.Errorf("--files-from: %s", err))
+			}
+			listedPaths = paths
+		}
 
-		runClient(connectUri)
-	} else {
-		fmt.Fprintln(os.Stderr, "One of --connect (-c), --server (-s) must be specified.")
+		switch {
+		case listVersionsOf != "" || restorePath != "":
+			runVersionCommand(connectUri)
+		case verify:
+			runVerify(connectUri)
+		case command == "status":
+			runStatus(connectUri)
+		case command == "ls":
+			runList(connectUri, path)
+		case command == "get":
+			runGet(connectUri, rest[1])
+		case command == "put":
+			runPut(connectUri, rest[1])
+		default:
+			runClient(connectUri)
+		}
 	}
 }
 
-// Simple error handling function. Prints the error to STDOUT and panics.
+// The status to exit with on errors. With --verify, it is 2 instead, like
+// diff, since 1 means that differences were found.
+var errorStatus = 1
+
+// Reports a mistake on the command line and exits.
+func usageError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	fmt.Fprintln(os.Stderr, "Run zync --help for usage.")
+	os.Exit(errorStatus)
+}
+
+// Simple error handling function. Logs the error and panics.
 func checkError(err error) {
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		logError(err)
 		panic(err)
 	}
 }
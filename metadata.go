@@ -0,0 +1,174 @@
+package main
+
+import "fmt"
+import "os"
+import "strings"
+
+// Optional protocol extensions, negotiated when a client connects. Each one
+// changes how files are synchronized, in both directions.
+type Extensions uint32
+const (
+	// Apply the sender's permission bits to received files.
+	ExtMode Extensions = 1 << iota
+
+	// Apply the sender's owner and group to received files, mapped by name.
+	ExtOwner
+
+	// Use numeric user and group IDs instead of mapping them by name.
+	ExtNumericIds
+
+	// Copy extended attributes (other than ACLs).
+	ExtXattrs
+
+	// Copy POSIX access control lists.
+	ExtACLs
+
+	// Recreate symbolic links as links, rather than following them.
+	ExtSymlinks
+
+	// Leave symbolic links out of the synchronization entirely.
+	ExtSkipSymlinks
+
+	// Recreate files with several hard links as hard links.
+	ExtHardLinks
+)
+
+// Extensions that must be sent in a FileMetadata message following the file
+// contents.
+const extFileMetadata = ExtOwner | ExtXattrs | ExtACLs
+
+// Extensions whose metadata can change who owns a file or what it may do, which
+// the server only negotiates if the share accepts them (see --accept-metadata).
+const extGuardedMetadata = ExtOwner | ExtNumericIds | ExtXattrs | ExtACLs
+
+// Extended attributes that hold POSIX ACLs, and ordinary ones. Attributes in
+// other namespaces (such as security.* and trusted.*) are never copied.
+const aclXattrPrefix = "system.posix_acl_"
+const userXattrPrefix = "user."
+
+var ExtensionNames = map[Extensions]string {
+	ExtMode: "mode",
+	ExtOwner: "owner",
+	ExtNumericIds: "numeric-ids",
+	ExtXattrs: "xattrs",
+	ExtACLs: "acls",
+	ExtSymlinks: "symlinks",
+	ExtSkipSymlinks: "skip-symlinks",
+	ExtHardLinks: "hard-links",
+}
+
+// File metadata that isn't part of FileInfo; only the fields for negotiated
+// extensions are populated.
+type FileMetadata struct {
+	Uid uint32
+	Gid uint32
+	Owner string
+	Group string
+	Xattrs map[string][]byte
+}
+
+// Extensions that the client asks for, based on its options.
+func requestedExtensions() (ext Extensions) {
+	if preserveMode {
+		ext |= ExtMode
+	}
+	if preserveOwner {
+		ext |= ExtOwner
+	}
+	if numericIds {
+		ext |= ExtNumericIds
+	}
+	if preserveXattrs {
+		ext |= ExtXattrs
+	}
+	if preserveACLs {
+		ext |= ExtACLs
+	}
+	if links == "preserve" {
+		ext |= ExtSymlinks
+	} else if links == "skip" {
+		ext |= ExtSkipSymlinks
+	}
+	if hardLinks {
+		ext |= ExtHardLinks
+	}
+	return
+}
+
+// Parses the names of metadata that a share accepts from clients: owner,
+// xattrs and acls.
+func parseAcceptedMetadata(names []string) (ext Extensions, err error) {
+	for _, name := range(names) {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "owner":
+			ext |= ExtOwner | ExtNumericIds
+		case "xattrs":
+			ext |= ExtXattrs
+		case "acls":
+			ext |= ExtACLs
+		default:
+			return 0, fmt.Errorf("Unknown metadata %s; expected owner, xattrs or acls", name)
+		}
+	}
+	return
+}
+
+// Whether an extended attribute is copied under the negotiated extensions.
+func xattrCopied(name string, ext Extensions) bool {
+	if strings.HasPrefix(name, aclXattrPrefix) {
+		return ext & ExtACLs != 0
+	}
+	return strings.HasPrefix(name, userXattrPrefix) && ext & ExtXattrs != 0
+}
+
+// Lists the names of a set of extensions, for logging.
+func extensionNames(ext Extensions) (names []string) {
+	for e := ExtMode; e <= ExtHardLinks; e <<= 1 {
+		if ext & e != 0 {
+			names = append(names, ExtensionNames[e])
+		}
+	}
+	return
+}
+
+// Applies metadata to a file that was just received. Failures are only
+// warned about; the file contents are still good.
+func applyMetadata(path string, fi FileInfo, md FileMetadata, ext Extensions) {
+	if ext & ExtOwner != 0 {
+		warnMetadata(path, "owner", setOwner(path, md, ext & ExtNumericIds != 0))
+	}
+
+	if ext & (ExtXattrs | ExtACLs) != 0 {
+		for name, value := range(md.Xattrs) {
+			if !xattrCopied(name, ext) {
+				logWarning("Ignoring extended attribute", name, "of", path)
+				continue
+			}
+			warnMetadata(path, name, setXattr(path, name, value))
+		}
+	}
+
+	// Mode is applied last, since changing the owner clears setuid/setgid.
+	// Those are only applied along with the owner, so that a file can't be
+	// made to run as whoever received it.
+	if ext & ExtMode != 0 {
+		mode := fi.Mode & (os.ModePerm | os.ModeSticky)
+		if ext & ExtOwner != 0 {
+			mode |= fi.Mode & (os.ModeSetuid | os.ModeSetgid)
+		}
+		warnMetadata(path, "mode", os.Chmod(path, mode))
+	}
+}
+
+func warnMetadata(path, what string, err error) {
+	if err == nil {
+		return
+	}
+
+	if os.IsPermission(err) {
+		logWarning("Insufficient privileges to set", what, "of", path)
+	} else {
+		logWarning("Failed to set", what, "of", path, err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import "os"
+import "os/user"
+import "strconv"
+import "strings"
+import "syscall"
+
+// Extensions that can be supported on this platform.
+const supportedExtensions = ExtMode | ExtOwner | ExtNumericIds | ExtXattrs | ExtACLs |
+	ExtSymlinks | ExtSkipSymlinks | ExtHardLinks
+
+// Reads the metadata of a file for the negotiated extensions.
+func readMetadata(path string, ext Extensions) (md FileMetadata, err error) {
+	if ext & ExtOwner != 0 {
+		var info os.FileInfo
+		info, err = os.Lstat(path)
+		if err != nil {
+			return
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			md.Uid = stat.Uid
+			md.Gid = stat.Gid
+		}
+
+		if ext & ExtNumericIds == 0 {
+			if u, err := user.LookupId(strconv.Itoa(int(md.Uid))); err == nil {
+				md.Owner = u.Username
+			}
+			if g, err := user.LookupGroupId(strconv.Itoa(int(md.Gid))); err == nil {
+				md.Group = g.Name
+			}
+		}
+	}
+
+	if ext & (ExtXattrs | ExtACLs) != 0 {
+		md.Xattrs, err = readXattrs(path, ext)
+	}
+
+	return
+}
+
+func readXattrs(path string, ext Extensions) (xattrs map[string][]byte, err error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return
+	}
+
+	xattrs = make(map[string][]byte)
+	for _, name := range(strings.Split(string(buf[:size]), "\x00")) {
+		if name == "" {
+			continue
+		}
+
+		if !xattrCopied(name, ext) {
+			continue
+		}
+
+		size, err = syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return
+		}
+
+		value := make([]byte, size)
+		size, err = syscall.Getxattr(path, name, value)
+		if err != nil {
+			return
+		}
+
+		xattrs[name] = value[:size]
+	}
+
+	return
+}
+
+// Sets the owner and group of a file, preferring to look them up by name
+// unless numeric is set or the names are unknown.
+func setOwner(path string, md FileMetadata, numeric bool) error {
+	uid, gid := int(md.Uid), int(md.Gid)
+
+	if !numeric && md.Owner != "" {
+		if u, err := user.Lookup(md.Owner); err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if !numeric && md.Group != "" {
+		if g, err := user.LookupGroup(md.Group); err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	return os.Lchown(path, uid, gid)
+}
+
+func setXattr(path, name string, value []byte) error {
+	err := syscall.Setxattr(path, name, value, 0)
+	if err != nil {
+		return &os.PathError { Op: "setxattr", Path: path, Err: err }
+	}
+	return nil
+}
+
+// Identifies the file behind info, if it has more than one hard link.
+func hardLinkID(info os.FileInfo) (id fileID, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return id, false
+	}
+
+	return fileID { dev: uint64(stat.Dev), ino: uint64(stat.Ino) }, true
+}
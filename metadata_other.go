@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+import "os"
+
+// Extensions that can be supported on this platform.
+const supportedExtensions = ExtMode |
+	ExtSymlinks | ExtSkipSymlinks
+
+// Reads the metadata of a file for the negotiated extensions. None of the
+// extensions that need it are supported on this platform.
+func readMetadata(path string, ext Extensions) (md FileMetadata, err error) {
+	return
+}
+
+func setOwner(path string, md FileMetadata, numeric bool) error {
+	return fmt.Errorf("Not supported on this platform")
+}
+
+func setXattr(path, name string, value []byte) error {
+	return fmt.Errorf("Not supported on this platform")
+}
+
+// Hard links are not detected on this platform.
+func hardLinkID(info os.FileInfo) (id fileID, ok bool) {
+	return
+}
@@ -0,0 +1,208 @@
+package main
+
+import "fmt"
+import "io"
+import "net"
+import "net/http"
+import "sort"
+import "sync"
+import "time"
+
+// Counters and gauges describing what the server is doing, served over HTTP
+// in the Prometheus text format when --metrics is given.
+type serverMetrics struct {
+	mu sync.Mutex
+	activeSessions int64
+	sessions int64
+	bytesSent int64
+	bytesReceived int64
+	filesSent int64
+	filesReceived int64
+
+	// Counts by reason.
+	refusals map[string]int64
+	handshakeFailures map[string]int64
+
+	sendDurations histogram
+	receiveDurations histogram
+}
+
+// Upper bounds, in seconds, of the buckets that transfer durations are
+// counted in.
+var durationBuckets = []float64 { 0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300 }
+
+type histogram struct {
+	counts []int64
+	count int64
+	sum float64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(durationBuckets))
+	}
+	for i, bound := range(durationBuckets) {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+var metrics = serverMetrics {
+	refusals: make(map[string]int64),
+	handshakeFailures: make(map[string]int64),
+}
+
+func (m *serverMetrics) sessionStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeSessions++
+	m.sessions++
+}
+
+func (m *serverMetrics) sessionEnded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeSessions--
+}
+
+// Counts a file sent to a client, which took the time since start.
+func (m *serverMetrics) fileSent(size int64, start time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.filesSent++
+	m.bytesSent += size
+	m.sendDurations.observe(time.Since(start).Seconds())
+}
+
+// Counts a file received from a client, which took the time since start.
+func (m *serverMetrics) fileReceived(size int64, start time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.filesReceived++
+	m.bytesReceived += size
+	m.receiveDurations.observe(time.Since(start).Seconds())
+}
+
+// Counts a request that the server refused.
+func (m *serverMetrics) refused(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refusals[reason]++
+}
+
+// Counts a connection that was dropped before the client got to make any
+// requests.
+func (m *serverMetrics) handshakeFailed(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handshakeFailures[reason]++
+}
+
+// Copies the metrics as they are now, so that they can be written out without
+// holding up the sessions that update them.
+func (m *serverMetrics) snapshot() *serverMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return &serverMetrics {
+		activeSessions: m.activeSessions,
+		sessions: m.sessions,
+		bytesSent: m.bytesSent,
+		bytesReceived: m.bytesReceived,
+		filesSent: m.filesSent,
+		filesReceived: m.filesReceived,
+		refusals: copyCounts(m.refusals),
+		handshakeFailures: copyCounts(m.handshakeFailures),
+		sendDurations: m.sendDurations.copy(),
+		receiveDurations: m.receiveDurations.copy(),
+	}
+}
+
+func copyCounts(counts map[string]int64) map[string]int64 {
+	copied := make(map[string]int64, len(counts))
+	for reason, count := range(counts) {
+		copied[reason] = count
+	}
+	return copied
+}
+
+func (h *histogram) copy() histogram {
+	return histogram { append([]int64(nil), h.counts...), h.count, h.sum }
+}
+
+// Writes all of the metrics in the Prometheus text format.
+func (m *serverMetrics) writeTo(w io.Writer) {
+	m = m.snapshot()
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("zync_sessions_active", "gauge", "Connections currently open.")
+	fmt.Fprintln(w, "zync_sessions_active", m.activeSessions)
+	metric("zync_sessions_total", "counter", "Connections accepted.")
+	fmt.Fprintln(w, "zync_sessions_total", m.sessions)
+
+	metric("zync_bytes_sent_total", "counter", "Bytes of file content sent to clients.")
+	fmt.Fprintln(w, "zync_bytes_sent_total", m.bytesSent)
+	metric("zync_bytes_received_total", "counter", "Bytes of file content received from clients.")
+	fmt.Fprintln(w, "zync_bytes_received_total", m.bytesReceived)
+
+	metric("zync_files_transferred_total", "counter", "Files sent to or received from clients.")
+	fmt.Fprintln(w, `zync_files_transferred_total{direction="sent"}`, m.filesSent)
+	fmt.Fprintln(w, `zync_files_transferred_total{direction="received"}`, m.filesReceived)
+
+	metric("zync_refusals_total", "counter", "Requests and connections refused, by reason.")
+	writeCounts(w, "zync_refusals_total", m.refusals)
+	metric("zync_handshake_failures_total", "counter", "Connections dropped during the handshake, by reason.")
+	writeCounts(w, "zync_handshake_failures_total", m.handshakeFailures)
+
+	metric("zync_transfer_duration_seconds", "histogram", "Time taken to transfer files.")
+	writeHistogram(w, "zync_transfer_duration_seconds", `direction="sent"`, &m.sendDurations)
+	writeHistogram(w, "zync_transfer_duration_seconds", `direction="received"`, &m.receiveDurations)
+}
+
+func writeCounts(w io.Writer, name string, counts map[string]int64) {
+	reasons := make([]string, 0, len(counts))
+	for reason := range(counts) {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	for _, reason := range(reasons) {
+		fmt.Fprintf(w, "%s{reason=%q} %d\n", name, reason, counts[reason])
+	}
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	for i, bound := range(durationBuckets) {
+		var count int64
+		if h.counts != nil {
+			count = h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, count)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// Starts serving the metrics at http://{addr}/metrics.
+func serveMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writeTo(w)
+	})
+
+	go http.Serve(listener, mux)
+	return nil
+}
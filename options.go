@@ -3,14 +3,53 @@ package main
 // Global Options
 var hash = false
 var verbose = false
+var logLevel = ""
+var logFormat = "text"
+var logFile = ""
+var rootDir = ""
+var noTrash = false
+var trashDays = 30
 
 // Server Options
 var port = 20741
 var restrict = false
 var restrictAll = false
+var readOnly = false
+var dropBox = false
+var configFile = ""
+var auditLogFile = ""
+var metricsAddr = ""
+var shutdownTimeout = 30
+var keepVersions = 0
+var keepVersionDays = 0
+var acceptMetadata Extensions = 0
 
 // Client Options
+var shareName = ""
+var userName = ""
+var tokenFile = ""
 var keepWhose = ""
 var autoDelete = false
+var forceDelete = false
+var maxDeletes = 0
+var maxDeletePercent = 50
 var reverse = false
 var interactive = false
+var jobs = 1
+var retries = 5
+var preserveMode = false
+var preserveOwner = false
+var numericIds = false
+var preserveXattrs = false
+var preserveACLs = false
+var links = "preserve"
+var safeLinks = false
+var hardLinks = false
+var listVersionsOf = ""
+var restorePath = ""
+var restoreVersionId = ""
+var syncPath = "."
+var filesFrom = ""
+var verify = false
+var listGlob = ""
+var listJSON = false
@@ -0,0 +1,83 @@
+package main
+
+import "sync"
+
+// Progress of the client's current synchronization, used to resume it after
+// the connection to the server is lost.
+var syncProgress progress
+
+// Tracks which paths the synchronization loop has finished with. Each path is
+// handled by a step, which is finished once the loop has moved on from it and
+// any transfers that it started (possibly in parallel, see --jobs) have
+// completed.
+type progress struct {
+	mu sync.Mutex
+
+	// Steps that have been started but not all finished, in order.
+	pending []*step
+	current *step
+
+	// The last path for which it and every path before it have been finished.
+	last string
+}
+
+type step struct {
+	path string
+	outstanding int
+}
+
+// Starts the step for the specified path.
+func (p *progress) begin(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.current = &step { path: path, outstanding: 1 }
+	p.pending = append(p.pending, p.current)
+}
+
+// Ends the current step. It is finished once all of its transfers are, too.
+func (p *progress) end() {
+	p.release(p.current)
+}
+
+// Adds a transfer to the current step. Returns a function to be called when
+// the transfer completes.
+func (p *progress) hold() func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.current
+	s.outstanding++
+	return func() {
+		p.release(s)
+	}
+}
+
+func (p *progress) release(s *step) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s.outstanding--
+	for len(p.pending) > 0 && p.pending[0].outstanding == 0 {
+		p.last = p.pending[0].path
+		p.pending = p.pending[1:]
+	}
+}
+
+// Forgets any steps that were not finished; they will be handled again.
+func (p *progress) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending = nil
+	p.current = nil
+}
+
+// Returns the last path for which it and every path before it have been
+// finished, or the empty string if there is none.
+func (p *progress) lastFinished() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.last
+}
@@ -1,21 +1,24 @@
 package main
 
 import "encoding/binary"
+import "errors"
 import "fmt"
 import "io"
-import "io/ioutil"
 import "os"
+import "path/filepath"
 import "time"
 
 type Version int32
 
-// Current protocol is v1.
-const ProtoVersion Version = 1
+// Current protocol is v13.
+const ProtoVersion Version = 13
 
 // Arbitrary limits to avoid allocating absurd amounts of space.
 const MaxFileSize int64 = 1024 * 1024 * 1024 * 32
 const MaxStringLength int32 = 1024
 const MaxTimeLength int32 = 16
+const MaxBytesLength int32 = 64 * 1024
+const MaxXattrCount int32 = 1024
 
 // Message terminator, to help debug protocol issues.
 const MessageTerminator int32 = 20741
@@ -39,6 +42,15 @@ const (
 	MsgTime
 	MsgUint32
 	MsgVersion
+	MsgEnumerateAfter
+	MsgBytes
+	MsgFileMetadata
+	MsgVersionListRequest
+	MsgVersionRestoreRequest
+	MsgShutdown
+	MsgEnumerateSubtree
+	MsgFileInfoRequest
+	MsgHashRequest
 )
 
 var MessageTypeNames = map[MessageType]string {
@@ -56,14 +68,52 @@ var MessageTypeNames = map[MessageType]string {
 	MsgTime: "MsgTime",
 	MsgUint32: "MsgUint32",
 	MsgVersion: "MsgVersion",
+	MsgEnumerateAfter: "MsgEnumerateAfter",
+	MsgBytes: "MsgBytes",
+	MsgFileMetadata: "MsgFileMetadata",
+	MsgVersionListRequest: "MsgVersionListRequest",
+	MsgVersionRestoreRequest: "MsgVersionRestoreRequest",
+	MsgShutdown: "MsgShutdown",
+	MsgEnumerateSubtree: "MsgEnumerateSubtree",
+	MsgFileInfoRequest: "MsgFileInfoRequest",
+	MsgHashRequest: "MsgHashRequest",
 }
 
+// Sent by the server in place of a reply when it is shutting down. Receiving
+// it fails with ErrServerShutdown.
+type Shutdown struct {}
+
+var ErrServerShutdown = errors.New("Server is shutting down.")
+
 // Enumeration of commands.
 type Command int32
 const (
 	CmdRequestNextFileInfo Command = iota
 )
 
+// Restarts the server's enumeration of its files from the first file after
+// the specified path.
+type EnumerateAfter struct {
+	Path string
+}
+
+// Restricts the server's enumeration of its files to those at and under the
+// specified path, and restarts it.
+type EnumerateSubtree struct {
+	Path string
+}
+
+// Asks the server for what its enumeration would report for a single path, if
+// anything.
+type FileInfoRequest struct {
+	Path string
+}
+
+// Asks the server for a checksum of a file's contents.
+type HashRequest struct {
+	Path string
+}
+
 type FileDeletionRequest struct {
 	Path string
 }
@@ -74,6 +124,17 @@ type FileInfo struct {
 	Mode os.FileMode
 	ModTime time.Time
 	Size int64
+
+	// Target of a symbolic link; empty for anything else.
+	Target string
+
+	// For a file with several hard links, the path that the file was first
+	// enumerated at, if this isn't it.
+	LinkTo string
+}
+
+func (fi FileInfo) IsLink() bool {
+	return fi.Mode & os.ModeSymlink != 0
 }
 
 type FileRequest struct {
@@ -84,6 +145,17 @@ type FileOffer struct {
 	Info FileInfo
 }
 
+// Asks the server for the versions it has kept of a path.
+type VersionListRequest struct {
+	Path string
+}
+
+// Asks the server to put a kept version of a path back in place.
+type VersionRestoreRequest struct {
+	Path string
+	Version string
+}
+
 // Writes a message to the connection.
 func send(conn io.Writer, msg Message) (err error) {
 	switch msg := msg.(type) {
@@ -91,16 +163,28 @@ func send(conn io.Writer, msg Message) (err error) {
 		err = fmt.Errorf("Unexpected type: %T", msg)
 	case bool:
 		err = sendBool(conn, msg)
+	case []byte:
+		err = sendBytes(conn, msg)
 	case Command:
 		err = sendCommand(conn, msg)
+	case EnumerateAfter:
+		err = sendEnumerateAfter(conn, msg)
+	case EnumerateSubtree:
+		err = sendEnumerateSubtree(conn, msg)
 	case FileDeletionRequest:
 		err = sendFileDeletionRequest(conn, msg)
 	case FileInfo:
 		err = sendFileInfo(conn, msg)
+	case FileInfoRequest:
+		err = sendFileInfoRequest(conn, msg)
+	case FileMetadata:
+		err = sendFileMetadata(conn, msg)
 	case FileOffer:
 		err = sendFileOffer(conn, msg)
 	case FileRequest:
 		err = sendFileRequest(conn, msg)
+	case HashRequest:
+		err = sendHashRequest(conn, msg)
 	case int32:
 		err = sendInt32(conn, msg)
 	case int64:
@@ -113,6 +197,12 @@ func send(conn io.Writer, msg Message) (err error) {
 		err = sendUint32(conn, msg)
 	case Version:
 		err = sendVersion(conn, msg)
+	case VersionListRequest:
+		err = sendVersionListRequest(conn, msg)
+	case VersionRestoreRequest:
+		err = sendVersionRestoreRequest(conn, msg)
+	case Shutdown:
+		err = writeMessageType(conn, MsgShutdown)
 	}
 
 	if err == nil {
@@ -148,16 +238,28 @@ func read(conn io.Reader, msgType MessageType) (msg Message, err error) {
 		}
 	case MsgBool:
 		msg, err = recvBool(conn)
+	case MsgBytes:
+		msg, err = recvBytes(conn)
 	case MsgCommand:
 		msg, err = recvCommand(conn)
+	case MsgEnumerateAfter:
+		msg, err = recvEnumerateAfter(conn)
+	case MsgEnumerateSubtree:
+		msg, err = recvEnumerateSubtree(conn)
 	case MsgFileDeletionRequest:
 		msg, err = recvFileDeletionRequest(conn)
 	case MsgFileInfo:
 		msg, err = recvFileInfo(conn)
+	case MsgFileInfoRequest:
+		msg, err = recvFileInfoRequest(conn)
+	case MsgFileMetadata:
+		msg, err = recvFileMetadata(conn)
 	case MsgFileOffer:
 		msg, err = recvFileOffer(conn)
 	case MsgFileRequest:
 		msg, err = recvFileRequest(conn)
+	case MsgHashRequest:
+		msg, err = recvHashRequest(conn)
 	case MsgInt32:
 		msg, err = recvInt32(conn)
 	case MsgInt64:
@@ -170,6 +272,10 @@ func read(conn io.Reader, msgType MessageType) (msg Message, err error) {
 		msg, err = recvUint32(conn)
 	case MsgVersion:
 		msg, err = recvVersion(conn)
+	case MsgVersionListRequest:
+		msg, err = recvVersionListRequest(conn)
+	case MsgVersionRestoreRequest:
+		msg, err = recvVersionRestoreRequest(conn)
 	}
 
 	return
@@ -253,6 +359,50 @@ func expectBool(conn io.Reader) (b bool, err error) {
 	return
 }
 
+func sendBytes(conn io.Writer, b []byte) (err error) {
+	err = writeMessageType(conn, MsgBytes)
+	if err != nil {
+		return
+	}
+
+	err = writeInt32(conn, int32(len(b)))
+	if err != nil {
+		return
+	}
+
+	_, err = conn.Write(b)
+	return
+}
+
+func recvBytes(conn io.Reader) (b []byte, err error) {
+	length, err := recvInt32(conn)
+	if err != nil {
+		return
+	}
+	if length > MaxBytesLength {
+		err = fmt.Errorf("Byte array of length %d exceeds max of %d", length, MaxBytesLength)
+		return
+	}
+
+	b = make([]byte, length)
+	_, err = io.ReadFull(conn, b)
+	return
+}
+
+func expectBytes(conn io.Reader) (b []byte, err error) {
+	msg, _, err := recv(conn)
+	if err != nil {
+		return
+	}
+
+	var ok bool
+	if b, ok = msg.([]byte); !ok {
+		err = fmt.Errorf("Expected []byte, got %T: %v", msg, msg)
+	}
+
+	return
+}
+
 func recvByte(conn io.Reader) (b byte, err error) {
 	buf := make([]byte, 1)
 	_, err = io.ReadFull(conn, buf)
@@ -293,7 +443,89 @@ func expectCommand(conn io.Reader) (cmd Command, err error) {
 	return
 }
 
-func sendFile(conn io.Writer, fi FileInfo, path string) (err error) {
+func sendEnumerateAfter(conn io.Writer, req EnumerateAfter) (err error) {
+	err = writeMessageType(conn, MsgEnumerateAfter)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, req.Path)
+	return
+}
+
+func recvEnumerateAfter(conn io.Reader) (req EnumerateAfter, err error) {
+	path, err := expectString(conn)
+	if err != nil {
+		return
+	}
+
+	req.Path = path
+	return
+}
+
+func sendEnumerateSubtree(conn io.Writer, req EnumerateSubtree) (err error) {
+	err = writeMessageType(conn, MsgEnumerateSubtree)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, req.Path)
+	return
+}
+
+func recvEnumerateSubtree(conn io.Reader) (req EnumerateSubtree, err error) {
+	path, err := expectString(conn)
+	if err != nil {
+		return
+	}
+
+	req.Path = path
+	return
+}
+
+func sendFileInfoRequest(conn io.Writer, req FileInfoRequest) (err error) {
+	err = writeMessageType(conn, MsgFileInfoRequest)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, req.Path)
+	return
+}
+
+func recvFileInfoRequest(conn io.Reader) (req FileInfoRequest, err error) {
+	path, err := expectString(conn)
+	if err != nil {
+		return
+	}
+
+	req.Path = path
+	return
+}
+
+func sendHashRequest(conn io.Writer, req HashRequest) (err error) {
+	err = writeMessageType(conn, MsgHashRequest)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, req.Path)
+	return
+}
+
+func recvHashRequest(conn io.Reader) (req HashRequest, err error) {
+	path, err := expectString(conn)
+	if err != nil {
+		return
+	}
+
+	req.Path = path
+	return
+}
+
+// Sends the contents of a file, followed by its metadata if any of the
+// negotiated extensions call for it.
+func sendFile(conn io.Writer, fi FileInfo, path string, ext Extensions) (err error) {
 	err = writeMessageType(conn, MsgFile)
 	if err != nil {
 		return
@@ -318,10 +550,22 @@ func sendFile(conn io.Writer, fi FileInfo, path string) (err error) {
 	}
 
 	err = writeMessageTerminator(conn)
+	if err != nil || ext & extFileMetadata == 0 {
+		return
+	}
+
+	md, err := readMetadata(path, ext)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, md)
 	return
 }
 
-func recvFile(conn io.Reader, expected FileInfo, targetPath string, overwrite bool) (err error) {
+// Receives the contents of a file (and its metadata, for the negotiated
+// extensions) and saves it to the target path.
+func recvFile(conn io.Reader, expected FileInfo, targetPath string, overwrite bool, ext Extensions) (err error) {
 	if !overwrite {
 		if _, err = os.Stat(targetPath); !os.IsNotExist(err) {
 			err = fmt.Errorf("Refusing to overwrite %s.", targetPath)
@@ -347,42 +591,64 @@ func recvFile(conn io.Reader, expected FileInfo, targetPath string, overwrite bo
 		return fmt.Errorf("File too large: %d bytes", fi.Size)
 	}
 
-	// File is saved to a temp file until fully received.
-	temp, err := ioutil.TempFile("", "zync")
+	// File is saved to a hidden temp file next to the target until fully
+	// received, then moved into place over it.
+	temp, err := os.OpenFile(tempName(targetPath), os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			temp.Close()
+			os.Remove(temp.Name())
+		}
+	}()
 
 	written, err := io.CopyN(temp, conn, fi.Size)
 	if err != nil {
-		temp.Close()
 		return
 	}
 	if written != fi.Size {
-		temp.Close()
 		return fmt.Errorf("Failed to receive full contents of %s (%d bytes)", expected.Path, fi.Size)
 	}
 
-	temp.Close()
-
 	err = checkMessageTerminator(conn)
 	if err != nil {
 		return
 	}
 
-	// Move the temp file to the specified location.
-	if overwrite {
-		err = os.Remove(targetPath)
-		if err != nil && !os.IsNotExist(err) {
+	var md FileMetadata
+	if ext & extFileMetadata != 0 {
+		md, err = expectFileMetadata(conn)
+		if err != nil {
 			return
 		}
 	}
 
+	// Make sure the contents are on disk before the rename, and the rename is
+	// on disk before carrying on.
+	err = temp.Sync()
+	if err != nil {
+		return
+	}
+
+	err = temp.Close()
+	if err != nil {
+		return
+	}
+
 	err = os.Rename(temp.Name(), targetPath)
 	if err != nil {
 		return
 	}
 
+	err = syncDir(filepath.Dir(targetPath))
+	if err != nil {
+		return
+	}
+
+	applyMetadata(targetPath, fi, md, ext)
+
 	// Update the modtime of the file to match the provider's.
 	err = os.Chtimes(targetPath, fi.ModTime, fi.ModTime)
 	return
@@ -435,6 +701,16 @@ func sendFileInfo(conn io.Writer, fi FileInfo) (err error) {
 	}
 
 	err = send(conn, fi.Size)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, fi.Target)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, fi.LinkTo)
 	return
 }
 
@@ -464,11 +740,23 @@ func recvFileInfo(conn io.Reader) (fi FileInfo, err error) {
 		return
 	}
 
+	target, err := expectString(conn)
+	if err != nil {
+		return
+	}
+
+	linkTo, err := expectString(conn)
+	if err != nil {
+		return
+	}
+
 	fi.Path = path
 	fi.IsDir = isDir
 	fi.Mode = os.FileMode(mode)
 	fi.ModTime = modTime
 	fi.Size = size
+	fi.Target = target
+	fi.LinkTo = linkTo
 	return
 }
 
@@ -486,6 +774,116 @@ func expectFileInfo(conn io.Reader) (fi FileInfo, err error) {
 	return
 }
 
+func sendFileMetadata(conn io.Writer, md FileMetadata) (err error) {
+	err = writeMessageType(conn, MsgFileMetadata)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, md.Uid)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, md.Gid)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, md.Owner)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, md.Group)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, int32(len(md.Xattrs)))
+	if err != nil {
+		return
+	}
+
+	for name, value := range(md.Xattrs) {
+		err = send(conn, name)
+		if err != nil {
+			return
+		}
+
+		err = send(conn, value)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func recvFileMetadata(conn io.Reader) (md FileMetadata, err error) {
+	md.Uid, err = expectUint32(conn)
+	if err != nil {
+		return
+	}
+
+	md.Gid, err = expectUint32(conn)
+	if err != nil {
+		return
+	}
+
+	md.Owner, err = expectString(conn)
+	if err != nil {
+		return
+	}
+
+	md.Group, err = expectString(conn)
+	if err != nil {
+		return
+	}
+
+	count, err := expectInt32(conn)
+	if err != nil {
+		return
+	}
+	if count < 0 || count > MaxXattrCount {
+		err = fmt.Errorf("Extended attribute count %d exceeds max of %d", count, MaxXattrCount)
+		return
+	}
+
+	md.Xattrs = make(map[string][]byte)
+	for i := int32(0); i < count; i++ {
+		var name string
+		name, err = expectString(conn)
+		if err != nil {
+			return
+		}
+
+		var value []byte
+		value, err = expectBytes(conn)
+		if err != nil {
+			return
+		}
+
+		md.Xattrs[name] = value
+	}
+
+	return
+}
+
+func expectFileMetadata(conn io.Reader) (md FileMetadata, err error) {
+	msg, _, err := recv(conn)
+	if err != nil {
+		return
+	}
+
+	var ok bool
+	if md, ok = msg.(FileMetadata); !ok {
+		err = fmt.Errorf("Expected FileMetadata, got %T: %v", msg, msg)
+	}
+
+	return
+}
+
 func sendFileOffer(conn io.Writer, offer FileOffer) (err error) {
 	err = writeMessageType(conn, MsgFileOffer)
 	if err != nil {
@@ -540,6 +938,20 @@ func recvInt32(conn io.Reader) (val int32, err error) {
 	return
 }
 
+func expectInt32(conn io.Reader) (val int32, err error) {
+	msg, _, err := recv(conn)
+	if err != nil {
+		return
+	}
+
+	var ok bool
+	if val, ok = msg.(int32); !ok {
+		err = fmt.Errorf("Expected int32, got %T: %v", msg, msg)
+	}
+
+	return
+}
+
 func writeInt32(conn io.Writer, val int32) (err error) {
 	return binary.Write(conn, binary.BigEndian, val)
 }
@@ -583,6 +995,12 @@ func writeMessageTerminator(conn io.Writer) error {
 func recvMessageType(conn io.Reader) (mt MessageType, err error) {
 	var msgType uint32
 	err = binary.Read(conn, binary.BigEndian, &msgType)
+	if err == nil && MessageType(msgType) == MsgShutdown {
+		err = checkMessageTerminator(conn)
+		if err == nil {
+			err = ErrServerShutdown
+		}
+	}
 	return MessageType(msgType), err
 }
 
@@ -761,3 +1179,54 @@ func expectVersion(conn io.Reader) (v Version, err error) {
 
 	return
 }
+
+func sendVersionListRequest(conn io.Writer, req VersionListRequest) (err error) {
+	err = writeMessageType(conn, MsgVersionListRequest)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, req.Path)
+	return
+}
+
+func recvVersionListRequest(conn io.Reader) (req VersionListRequest, err error) {
+	path, err := expectString(conn)
+	if err != nil {
+		return
+	}
+
+	req.Path = path
+	return
+}
+
+func sendVersionRestoreRequest(conn io.Writer, req VersionRestoreRequest) (err error) {
+	err = writeMessageType(conn, MsgVersionRestoreRequest)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, req.Path)
+	if err != nil {
+		return
+	}
+
+	err = send(conn, req.Version)
+	return
+}
+
+func recvVersionRestoreRequest(conn io.Reader) (req VersionRestoreRequest, err error) {
+	path, err := expectString(conn)
+	if err != nil {
+		return
+	}
+
+	version, err := expectString(conn)
+	if err != nil {
+		return
+	}
+
+	req.Path = path
+	req.Version = version
+	return
+}
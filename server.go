@@ -4,146 +4,678 @@ import "fmt"
 import "io"
 import "net"
 import "os"
+import "os/signal"
 import "path/filepath"
+import "sync/atomic"
+import "syscall"
+import "time"
 
 func runServer() {
-	root, err := os.Getwd()
-	checkError(err)
+	config := flagConfig()
+	if configFile != "" {
+		var err error
+		config, err = loadConfig(configFile)
+		if err != nil {
+			logError(err)
+			os.Exit(1)
+		}
+	}
+	setConfig(config)
+
+	if err := configureLogs(config.LogLevel, config.LogFormat, config.LogFile); err != nil {
+		logError(err)
+		os.Exit(1)
+	}
+	if err := audit.open(config.AuditLog); err != nil {
+		logError(err)
+		os.Exit(1)
+	}
+
+	logInfo("Zync server starting...")
+	prepareShares(config, nil)
 
-	fmt.Println("Zync server starting...")
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	listener, err := net.Listen("tcp", config.Listen)
 	checkError(err)
 
-	fmt.Printf("Zync server started on port %d.\n", port)
+	if config.Metrics != "" {
+		if err := serveMetrics(config.Metrics); err != nil {
+			logError(err)
+			os.Exit(1)
+		}
+		logInfo(fmt.Sprintf("Serving metrics at http://%s/metrics.", config.Metrics))
+	}
+
+	if configFile != "" {
+		go reloadOnHangup()
+	}
+	go shutdownOnSignal(listener)
+
+	logInfo(fmt.Sprintf("Zync server started on %s.", config.Listen))
+	var active int32
+	delay := acceptRetryDelay
 	for {
 		conn, err := listener.Accept()
-		checkError(err)
-		defer conn.Close()
-		handleConnection(conn, root)
-		fmt.Println("Client disconnected.")
+		if err != nil {
+			if sessions.isClosing() {
+				break
+			}
+
+			// Errors such as running out of file descriptors pass; wait a
+			// little (longer each time) and try again.
+			logWarning("Failed to accept connection:", err)
+			time.Sleep(delay)
+			if delay *= 2; delay > maxAcceptRetryDelay {
+				delay = maxAcceptRetryDelay
+			}
+			continue
+		}
+		delay = acceptRetryDelay
+
+		config := currentConfig()
+		if config.MaxConnections > 0 && atomic.LoadInt32(&active) >= int32(config.MaxConnections) {
+			logWarning("Too many connections; refusing", conn.RemoteAddr())
+			metrics.refused("too many connections")
+			conn.Close()
+			continue
+		}
+
+		s := sessions.open(conn)
+		if s == nil {
+			conn.Close()
+			continue
+		}
+
+		// Clients may open several connections at once (see --jobs), so each
+		// one is handled independently.
+		atomic.AddInt32(&active, 1)
+		metrics.sessionStarted()
+		go func() {
+			defer atomic.AddInt32(&active, -1)
+			defer metrics.sessionEnded()
+			defer sessions.close(s)
+			handleConnection(s, config)
+		}()
+	}
+
+	// Shutting down; wait for clients to finish what they are doing, then
+	// clean up after any transfers that were cut off.
+	sessions.shutdown(time.Duration(shutdownTimeout) * time.Second)
+	config = currentConfig()
+	for _, share := range(append(config.shareList(), config.Root)) {
+		removeTempFiles(share.Root)
 	}
+	logInfo("Zync server stopped.")
 }
 
-func handleConnection(conn net.Conn, root string) {
+// Delays between attempts to accept connections after an error.
+const acceptRetryDelay = 5 * time.Millisecond
+const maxAcceptRetryDelay = 1 * time.Second
+
+// Stops the server from accepting connections when it receives SIGINT or
+// SIGTERM, so that it can shut down.
+func shutdownOnSignal(listener net.Listener) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-stop
+	logInfo("Received", sig, "signal; shutting down.")
+
+	sessions.stopAccepting()
+	listener.Close()
+
+	// A second signal stops the server immediately.
+	<-stop
+	logWarning("Stopping immediately.")
+	os.Exit(1)
+}
+
+// Cleans up the roots of the shares in a new configuration, skipping any that
+// were already in use (and might have transfers in progress).
+func prepareShares(config, previous *Config) {
+	inUse := make(map[string]bool)
+	if previous != nil {
+		for _, share := range(append(previous.shareList(), previous.Root)) {
+			inUse[share.Root] = true
+		}
+	}
+
+	logInfo("Root folder is", config.Root.Root)
+	for _, share := range(config.shareList()) {
+		logInfo("Sharing", share.Root, "as", share.Name)
+	}
+
+	for _, share := range(append(config.shareList(), config.Root)) {
+		if inUse[share.Root] {
+			continue
+		}
+		inUse[share.Root] = true
+
+		removeTempFiles(share.Root)
+		purgeTrash(share.Root)
+		if share.keepingVersions() {
+			pruneAllVersions(share)
+		}
+	}
+}
+
+// Reads the config file again whenever the server receives SIGHUP. Clients
+// that are already connected carry on with the settings they started with.
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for _ = range(hup) {
+		logInfo("Reloading", configFile)
+		config, err := loadConfig(configFile)
+		if err != nil {
+			logError(err)
+			logError("Keeping the current configuration.")
+			continue
+		}
+
+		if err := configureLogs(config.LogLevel, config.LogFormat, config.LogFile); err != nil {
+			logError(err)
+			logError("Keeping the current configuration.")
+			continue
+		}
+		if err := audit.open(config.AuditLog); err != nil {
+			logError(err)
+			logError("Keeping the current configuration.")
+			continue
+		}
+
+		previous := currentConfig()
+		if config.Listen != previous.Listen {
+			logWarning("The listen address only changes when the server is restarted.")
+		}
+		if config.Metrics != previous.Metrics {
+			logWarning("The metrics address only changes when the server is restarted.")
+		}
+
+		prepareShares(config, previous)
+		setConfig(config)
+	}
+}
+
+func handleConnection(s *session, config *Config) {
+	conn := s.conn
+	defer conn.Close()
+
 	// Server cuts off client on any error, but continues running.
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Fprintln(os.Stderr, "Disconnecting client abnormally.")
+			s.logError("Disconnecting client abnormally:", r)
+			s.audit("disconnect", "", 0, auditFailed, fmt.Sprint(r))
+		} else {
+			s.logInfo("Client disconnected.")
+			s.audit("disconnect", "", 0, auditOK, "")
 		}
 	}()
 
-	fmt.Println("Client connected:", conn.RemoteAddr())
+	s.logInfo("Client connected:", conn.RemoteAddr())
 
 	version, err := expectVersion(conn)
 	checkError(err)
 
-	fmt.Println("Client requested protocol version:", version)
+	s.logInfo("Client requested protocol version:", version)
 	if version != ProtoVersion {
 		// Exact match on version is required (currently).
+		s.audit("connect", "", 0, auditRefused, fmt.Sprint("protocol version ", version))
+		metrics.handshakeFailed("protocol version")
 		checkError(send(conn, false))
 		return
 	} else {
+		s.audit("connect", "", 0, auditOK, "")
 		checkError(send(conn, true))
 	}
 
-	files := enumerateFiles(root)
+	// Authentication, if the server has any users.
+	user, claimed, ok := authenticate(conn, config)
+	s.user = claimed
+	if !ok {
+		s.logWarning("Client failed to authenticate as", claimed)
+		s.audit("auth", "", 0, auditRefused, "invalid credentials")
+		metrics.handshakeFailed("invalid credentials")
+		return
+	}
+
+	// What the client may do; nil if it may do anything.
+	var access *Access
+	if user != nil {
+		s.logVerbose("Client authenticated as", user.Name)
+		s.audit("auth", "", 0, auditOK, "")
+		access = user.Access
+	} else {
+		s.user = ""
+	}
+
+	// Share selection; the default share is used if the client doesn't name
+	// one.
+	name, err := expectString(conn)
+	checkError(err)
+	share, ok := config.lookupShare(name)
+	checkError(send(conn, ok))
+	s.share = name
+	if !ok {
+		s.logWarning("Client requested unknown share", name)
+		s.audit("share", "", 0, auditRefused, "unknown share")
+		metrics.handshakeFailed("unknown share")
+		return
+	} else if name != "" {
+		s.logVerbose("Client requested share", name)
+	}
+	root := share.Root
+
+	// Accept whichever of the requested extensions are supported here, except
+	// for metadata that the share doesn't accept from clients.
+	requested, err := expectUint32(conn)
+	checkError(err)
+	ext := Extensions(requested) & supportedExtensions &^ (extGuardedMetadata &^ share.AcceptMetadata)
+	checkError(send(conn, uint32(ext)))
+	if ext != 0 {
+		s.logVerbose("Using extensions:", extensionNames(ext))
+	}
+
+	// Files are only enumerated once the client asks for them; connections
+	// that are used purely for transfers never do.
+	var files <-chan FileInfo
+	var lastSentFilePath string
+
+	// The part of the share being enumerated; see EnumerateSubtree.
+	subtree := "."
+
+	// Permissions and times of folders created by the client are set when it
+	// disconnects, by which point any of its other connections are done.
+	var createdDirs dirFixups
+	defer createdDirs.apply(root)
 	for {
+		if !sessions.idle(s) {
+			return
+		}
+
 		msg, msgType, err := recv(conn)
 		if err == io.EOF {
 			return
 		}
 
 		checkError(err)
+		if !sessions.busy(s) {
+			return
+		}
 
 		switch msgType {
 		case MsgCommand:
 			switch msg.(Command) {
 			case CmdRequestNextFileInfo:
-				handleCmdRequestNextFileInfo(conn, files)
+				if files == nil {
+					files = enumerateShare(share, access, subtree, "", ext)
+				}
+				lastSentFilePath = handleCmdRequestNextFileInfo(conn, files)
 			default:
 				panic(fmt.Errorf("Unrecognized command: %d", msg))
 			}
+		case MsgEnumerateAfter:
+			// Client is resuming an interrupted synchronization.
+			files = enumerateShare(share, access, subtree, msg.(EnumerateAfter).Path, ext)
+			lastSentFilePath = ""
+			checkError(send(conn, true))
+		case MsgEnumerateSubtree:
+			// Client only wants part of the share.
+			req := msg.(EnumerateSubtree)
+			if handleMsgEnumerateSubtree(s, share, access, req) {
+				subtree = filepath.Clean(req.Path)
+				files = enumerateShare(share, access, subtree, "", ext)
+				lastSentFilePath = ""
+			}
+		case MsgFileInfoRequest:
+			// Client is comparing a list of paths rather than everything.
+			lastSentFilePath = handleMsgFileInfoRequest(s, share, access, ext, msg.(FileInfoRequest))
 		case MsgFileDeletionRequest:
-			handleMsgFileDeletionRequest(conn, root, msg.(FileDeletionRequest))
+			handleMsgFileDeletionRequest(s, share, access, lastSentFilePath, msg.(FileDeletionRequest))
 		case MsgFileOffer:
-			handleMsgFileOffer(conn, root, msg.(FileOffer))
+			handleMsgFileOffer(s, share, access, ext, &createdDirs, msg.(FileOffer))
 		case MsgFileRequest:
-			handleMsgFileRequest(conn, root, msg.(FileRequest))
+			handleMsgFileRequest(s, share, access, ext, msg.(FileRequest))
+		case MsgHashRequest:
+			handleMsgHashRequest(s, share, access, msg.(HashRequest))
+		case MsgVersionListRequest:
+			handleMsgVersionListRequest(s, share, access, msg.(VersionListRequest))
+		case MsgVersionRestoreRequest:
+			handleMsgVersionRestoreRequest(s, share, access, msg.(VersionRestoreRequest))
 		default:
 			panic(fmt.Errorf("Unrecognized message type: %d", msgType))
 		}
 	}
 }
 
-var lastSentFilePath string
+// Enumerates the files in a share at and under subtree, after the specified
+// path (or all of them, if it is empty), that the client may see. Drop boxes
+// never list their files.
+func enumerateShare(share *Share, access *Access, subtree, after string, ext Extensions) (<-chan FileInfo) {
+	if share.DropBox {
+		files := make(chan FileInfo)
+		close(files)
+		return files
+	}
+
+	return filterFiles(share.Root, enumerateFilesAfter(share.Root, subtree, after, ext, true), access)
+}
+
+// Checks that a client may enumerate a subtree of a share: it lies within the
+// share, and the client may see it. Replies with whether it may. The subtree
+// needn't exist; if it doesn't, nothing is enumerated.
+func handleMsgEnumerateSubtree(s *session, share *Share, access *Access, req EnumerateSubtree) bool {
+	s.logVerbose("Client requested the files under", req.Path)
+
+	ok := validPath(req.Path) && access.canList(req.Path) && inShare(share.Root, req.Path)
+	if !ok {
+		s.logWarning("Refusing to list", req.Path)
+		s.audit("list", req.Path, 0, auditRefused, "invalid path")
+		metrics.refused("invalid path")
+	}
+	checkError(send(s.conn, ok))
+	return ok
+}
+
+// Whether a path lies within the share once any links in the way are
+// resolved. The path itself may be a link, but not the folders it is in, so
+// that it can't lead outside of the share; the deepest of them that exists is
+// checked.
+func inShare(root, path string) bool {
+	resolved, ok := resolveParent(root, path)
+	return ok && resolved == filepath.Clean(path)
+}
+
+// Sends the client what the enumeration would report for a single path, if
+// the share has it and the client may see it. Returns the path if it was sent
+// (so that the client may then ask to delete it), or the empty string.
+func handleMsgFileInfoRequest(s *session, share *Share, access *Access, ext Extensions, req FileInfoRequest) string {
+	s.logVerbose("Client requested information on", req.Path)
 
-func handleCmdRequestNextFileInfo(conn net.Conn, files <-chan FileInfo) {
+	if !validPath(req.Path) || !inShare(share.Root, req.Path) {
+		s.logWarning("Refusing to look up", req.Path)
+		s.audit("list", req.Path, 0, auditRefused, "invalid path")
+		metrics.refused("invalid path")
+		checkError(send(s.conn, false))
+		return ""
+	}
+
+	// Drop boxes never list their files.
+	fi, ok := statFile(share.Root, filepath.Clean(req.Path), ext, true)
+	if !ok || share.DropBox || !access.canList(fi.Path) {
+		checkError(send(s.conn, false))
+		return ""
+	}
+
+	checkError(send(s.conn, true))
+	checkError(send(s.conn, fi))
+	return fi.Path
+}
+
+// Sends the next file in the enumeration to the client, returning its path (or
+// the empty string if there are no more files).
+func handleCmdRequestNextFileInfo(conn net.Conn, files <-chan FileInfo) string {
 	fi, ok := <-files
 	if ok {
 		checkError(send(conn, true))
 		checkError(send(conn, fi))
-		lastSentFilePath = fi.Path
+		return fi.Path
 	} else {
 		checkError(send(conn, false))
+		return ""
 	}
 }
 
-func handleMsgFileDeletionRequest(conn net.Conn, root string, req FileDeletionRequest) {
-	logVerbose("Client requested deletion of", req.Path)
+func handleMsgFileDeletionRequest(s *session, share *Share, access *Access, lastSentFilePath string, req FileDeletionRequest) {
+	s.logVerbose("Client requested deletion of", req.Path)
+	conn := s.conn
+	root := share.Root
 
-	if restrict || restrictAll {
-		// Server was run with the --restrict (-r) or --Restrict (-R) option;
-		// refuse to delete any file.
+	refuse := func(reason string) {
+		s.audit("delete", req.Path, 0, auditRefused, reason)
+		metrics.refused(reason)
 		checkError(send(conn, false))
+	}
+
+	if share.Restrict || share.RestrictAll || share.ReadOnly || share.DropBox {
+		// Server was run with the --restrict (-r) or --Restrict (-R) option,
+		// or the share is read-only or a drop box; refuse to delete any file.
+		refuse("restricted")
+	} else if !validPath(req.Path) {
+		refuse("invalid path")
+	} else if !canDeleteResolved(root, access, req.Path) {
+		refuse("access denied")
 	} else if lastSentFilePath != req.Path {
 		// Refuse to delete the file if it isn't the last file that the server
 		// informed the client of. Otherwise, the client could be trying
 		// something sneaky...
-		checkError(send(conn, false))
+		refuse("not the last file listed")
 	} else {
-		// Delete the local file.
+		// Delete the local file, or move it to the version store if versions
+		// are kept.
 		checkError(send(conn, true))
-		deleteLocalFile(root, req.Path)
+		if saveVersion(share, req.Path, true) {
+			s.audit("delete", req.Path, 0, auditOK, "versioned")
+		} else {
+			deleteLocalFile(root, req.Path)
+			s.audit("delete", req.Path, 0, auditOK, "")
+		}
 	}
 }
 
 var fileBuffer = make([]byte, 1024 * 1024)
-func handleMsgFileRequest(conn net.Conn, root string, req FileRequest) {
-	logVerbose("Client requested", req.Path)
+func handleMsgFileRequest(s *session, share *Share, access *Access, ext Extensions, req FileRequest) {
+	s.logVerbose("Client requested", req.Path)
+	conn := s.conn
+	root := share.Root
 
-	abs := filepath.Join(root, req.Path)
-	if fStat, err := os.Stat(abs); os.IsNotExist(err) {
-		logWarning("Client requested nonexistant file", req.Path)
+	refuse := func(reason string) {
+		s.audit("request", req.Path, 0, auditRefused, reason)
+		metrics.refused(reason)
 		checkError(send(conn, false))
+	}
+
+	abs := filepath.Join(root, req.Path)
+	if !validPath(req.Path) {
+		s.logWarning("Client requested invalid path", req.Path)
+		refuse("invalid path")
+	} else if share.DropBox {
+		s.logVerbose("Refusing to send", req.Path, "(drop box)")
+		refuse("drop box")
+	} else if !canReadResolved(root, access, req.Path) {
+		s.logWarning("Client may not read", req.Path)
+		refuse("access denied")
+	} else if fStat, err := os.Stat(abs); os.IsNotExist(err) {
+		s.logWarning("Client requested nonexistant file", req.Path)
+		refuse("not found")
 	} else {
-		logInfo("Sending", req.Path, "to client.")
+		s.logInfo("Sending", req.Path, "to client.")
 		checkError(send(conn, true))
 
 		fi, err := fileInfo(root, abs, fStat)
 		checkError(err)
-		checkError(sendFile(conn, fi, abs))
+
+		start := time.Now()
+		err = sendFile(conn, fi, abs, ext)
+		if err != nil {
+			s.audit("request", req.Path, fi.Size, auditFailed, err.Error())
+		} else {
+			s.audit("request", req.Path, fi.Size, auditOK, "")
+			metrics.fileSent(fi.Size, start)
+		}
+		checkError(err)
 	}
 }
 
-func handleMsgFileOffer(conn net.Conn, root string, offer FileOffer) {
+// Sends the client a checksum of a file, so that it can compare contents
+// without transferring them (see --verify).
+func handleMsgHashRequest(s *session, share *Share, access *Access, req HashRequest) {
+	s.logVerbose("Client requested a checksum of", req.Path)
+	conn := s.conn
+	root := share.Root
+
+	refuse := func(reason string) {
+		s.audit("hash", req.Path, 0, auditRefused, reason)
+		metrics.refused(reason)
+		checkError(send(conn, false))
+	}
+
+	abs := filepath.Join(root, req.Path)
+	if !validPath(req.Path) {
+		s.logWarning("Client requested invalid path", req.Path)
+		refuse("invalid path")
+	} else if share.DropBox {
+		refuse("drop box")
+	} else if !canReadResolved(root, access, req.Path) {
+		s.logWarning("Client may not read", req.Path)
+		refuse("access denied")
+	} else if sum, err := fileHash(abs); err != nil {
+		s.logWarning("Cannot compute checksum:", err)
+		refuse("not found")
+	} else {
+		checkError(send(conn, true))
+		checkError(send(conn, sum))
+	}
+}
+
+func handleMsgFileOffer(s *session, share *Share, access *Access, ext Extensions, createdDirs *dirFixups, offer FileOffer) {
+	conn := s.conn
+	root := share.Root
 	path := filepath.Join(root, offer.Info.Path)
 
-	_, err := os.Stat(path)
-	if restrictAll && !os.IsNotExist(err) {
-		// Refuse the offer; server was run in --Restrict (-R) mode.
-		logVerbose("Rejecting client's", offer.Info.Path)
+	refuse := func(reason string) {
+		s.audit("offer", offer.Info.Path, offer.Info.Size, auditRefused, reason)
+		metrics.refused(reason)
 		checkError(send(conn, false))
+	}
+
+	if !validPath(offer.Info.Path) {
+		s.logWarning("Client offered invalid path", offer.Info.Path)
+		refuse("invalid path")
+		return
+	}
+
+	// Anything other than the path not existing (such as a file where one of
+	// its folders should be) is a conflict that the offer can't resolve.
+	info, err := os.Lstat(path)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		s.logWarning("Cannot accept", offer.Info.Path, err)
+		refuse("tree conflict")
+		return
+	} else if share.ReadOnly {
+		s.logVerbose("Rejecting client's", offer.Info.Path, "(read-only)")
+		refuse("read-only")
+		return
+	} else if !canWriteResolved(root, access, offer.Info.Path) {
+		s.logWarning("Client may not write", offer.Info.Path)
+		refuse("access denied")
+		return
+	} else if (share.RestrictAll || share.DropBox) && exists {
+		// Refuse the offer; server was run in --Restrict (-R) mode, or is a
+		// drop box, which only accepts new files.
+		s.logVerbose("Rejecting client's", offer.Info.Path)
+		refuse("restricted")
+		return
+	}
+
+	// Keep a version of whatever the client's file is about to replace.
+	refused := offer.Info.IsLink() && linkLeadsOut(root, offer.Info)
+	if exists && !info.IsDir() && !offer.Info.IsDir && !refused {
+		saveVersion(share, offer.Info.Path, false)
+	}
+
+	if offer.Info.IsLink() {
+		// Reject the offer, create the link directly. Links that point
+		// outside of the server's root are never created.
+		if refused {
+			s.logWarning("Refusing link that escapes the root:", offer.Info.Path, "->", offer.Info.Target)
+			refuse("link escapes root")
+		} else {
+			checkError(send(conn, false))
+			s.logVerbose("Creating link", offer.Info.Path)
+			checkError(createSymlink(root, offer.Info, true))
+			s.audit("offer", offer.Info.Path, 0, auditOK, "link")
+		}
+	} else if validPath(offer.Info.LinkTo) && inShare(root, offer.Info.LinkTo) &&
+		canReadResolved(root, access, offer.Info.LinkTo) && restoreHardLink(root, offer.Info) {
+		// Reject the offer; the file was linked to one the server already
+		// has.
+		checkError(send(conn, false))
+		s.audit("offer", offer.Info.Path, offer.Info.Size, auditOK, "hard link")
 	} else if offer.Info.IsDir {
 		// Reject the offer, create the folder directly.
-		logVerbose("Creating folder", offer.Info.Path)
-		checkError(os.Mkdir(path, os.ModeDir | offer.Info.Mode))
+		s.logVerbose("Creating folder", offer.Info.Path)
+		checkError(createdDirs.makeDir(root, offer.Info))
 		checkError(send(conn, false))
+		s.audit("offer", offer.Info.Path, 0, auditOK, "folder")
 	} else {
 		// Accept the offer.
 		checkError(send(conn, true))
+		s.audit("offer", offer.Info.Path, offer.Info.Size, auditOK, "")
 
 		// Receive the file.
-		logInfo("Receiving", offer.Info.Path, "from client.")
-		checkError(recvFile(conn, offer.Info, path, true))
+		s.logInfo("Receiving", offer.Info.Path, "from client.")
+		start := time.Now()
+		err := recvFile(conn, offer.Info, path, true, ext)
+		if err != nil {
+			s.audit("receive", offer.Info.Path, offer.Info.Size, auditFailed, err.Error())
+		} else {
+			s.audit("receive", offer.Info.Path, offer.Info.Size, auditOK, "")
+			metrics.fileReceived(offer.Info.Size, start)
+		}
+		checkError(err)
+		checkError(send(conn, true))
+	}
+}
+
+func handleMsgVersionListRequest(s *session, share *Share, access *Access, req VersionListRequest) {
+	s.logVerbose("Client requested versions of", req.Path)
+	conn := s.conn
+	root := share.Root
+
+	var versions []string
+	if validPath(req.Path) && !share.DropBox && access.canRead(req.Path) {
+		versions = listVersions(root, req.Path)
+	}
+
+	checkError(send(conn, int32(len(versions))))
+	for _, version := range(versions) {
+		stored := versionPath(root, req.Path, version)
+		info, err := os.Lstat(stored)
+		checkError(err)
+
+		fi, err := fileInfo(filepath.Dir(stored), stored, info)
+		checkError(err)
+
+		fi.Path = req.Path
+		checkError(send(conn, version))
+		checkError(send(conn, fi))
+	}
+}
+
+func handleMsgVersionRestoreRequest(s *session, share *Share, access *Access, req VersionRestoreRequest) {
+	s.logInfo("Client requested restoring version", req.Version, "of", req.Path)
+	conn := s.conn
+	root := share.Root
+
+	_, err := os.Lstat(filepath.Join(root, req.Path))
+	if !validPath(req.Path) || !validVersion(req.Version) {
+		s.logWarning("Client requested invalid version", req.Version, "of", req.Path)
+		s.audit("restore", req.Path, 0, auditRefused, "invalid path")
+		metrics.refused("invalid path")
+		checkError(send(conn, false))
+	} else if share.ReadOnly || share.DropBox || !canWriteResolved(root, access, req.Path) ||
+		(share.RestrictAll && !os.IsNotExist(err)) {
+		s.audit("restore", req.Path, 0, auditRefused, "access denied")
+		metrics.refused("access denied")
+		checkError(send(conn, false))
+	} else if err := restoreVersion(share, req.Path, req.Version); err != nil {
+		s.logWarning("Failed to restore", req.Path, err)
+		s.audit("restore", req.Path, 0, auditFailed, err.Error())
+		checkError(send(conn, false))
+	} else {
+		s.audit("restore", req.Path, 0, auditOK, req.Version)
+		checkError(send(conn, true))
 	}
 }
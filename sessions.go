@@ -0,0 +1,166 @@
+package main
+
+import "net"
+import "sync"
+import "time"
+
+// Tracks the server's open connections, so that it can shut down without
+// cutting off transfers that are in progress.
+type sessionSet struct {
+	mu sync.Mutex
+	wg sync.WaitGroup
+	closing bool
+	sessions map[*session]bool
+	lastID uint64
+}
+
+// A connection, and whether it is handling a request (as opposed to waiting
+// for the next one).
+type session struct {
+	// Numbers sessions from 1, to tell their log messages apart.
+	id uint64
+
+	conn net.Conn
+	busy bool
+	notified bool
+
+	// Who is on the other end, for the audit log.
+	addr string
+	user string
+	share string
+}
+
+var sessions = sessionSet { sessions: make(map[*session]bool) }
+
+// Registers a new connection. Returns nil if the server is shutting down.
+func (set *sessionSet) open(conn net.Conn) *session {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	if set.closing {
+		return nil
+	}
+
+	// Sessions start out busy with the handshake.
+	set.lastID++
+	s := &session { id: set.lastID, conn: conn, busy: true, addr: conn.RemoteAddr().String() }
+	set.sessions[s] = true
+	set.wg.Add(1)
+	return s
+}
+
+func (set *sessionSet) close(s *session) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	delete(set.sessions, s)
+	set.wg.Done()
+}
+
+// Called before waiting for the session's next request. Returns false if the
+// server is shutting down, in which case the client has been told so.
+func (set *sessionSet) idle(s *session) bool {
+	set.mu.Lock()
+	s.busy = false
+	closing := set.closing
+	notify := closing && set.notify(s)
+	set.mu.Unlock()
+
+	if notify {
+		sendShutdown(s)
+	}
+	return !closing
+}
+
+// Called once the session has received a request. Returns false if the server
+// started shutting down while waiting for it, in which case the request should
+// be dropped; the client has already been told.
+func (set *sessionSet) busy(s *session) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	s.busy = true
+	return !s.notified
+}
+
+// Marks a session as told that the server is shutting down, returning false if
+// it already was. Called with the lock held; the message itself is sent with
+// sendShutdown once it is released, so that a client that has stopped reading
+// can't hold up the others.
+func (set *sessionSet) notify(s *session) bool {
+	if s.notified {
+		return false
+	}
+	s.notified = true
+	return true
+}
+
+// How long to wait for a client to take the message that the server is
+// shutting down.
+const shutdownNoticeTimeout = 1 * time.Second
+
+// Tells a client that the server is shutting down, in place of a reply to
+// whatever it asks next.
+func sendShutdown(s *session) {
+	s.conn.SetWriteDeadline(time.Now().Add(shutdownNoticeTimeout))
+	send(s.conn, Shutdown {})
+	s.conn.SetWriteDeadline(time.Time {})
+}
+
+// Stops accepting new sessions.
+func (set *sessionSet) stopAccepting() {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.closing = true
+}
+
+func (set *sessionSet) isClosing() bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return set.closing
+}
+
+// Stops accepting new sessions and tells every client that the server is
+// shutting down; sessions that are handling a request do so once they finish
+// it. Waits up to the specified timeout for all sessions to end, then closes
+// any that are left.
+func (set *sessionSet) shutdown(timeout time.Duration) {
+	set.mu.Lock()
+	set.closing = true
+	var idle []*session
+	for s := range(set.sessions) {
+		if !s.busy && set.notify(s) {
+			idle = append(idle, s)
+		}
+	}
+	set.mu.Unlock()
+
+	for _, s := range(idle) {
+		go sendShutdown(s)
+	}
+
+	done := make(chan bool)
+	go func() {
+		set.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	set.mu.Lock()
+	logWarning("Closing", len(set.sessions), "connections that are still open.")
+	for s := range(set.sessions) {
+		s.conn.Close()
+	}
+	set.mu.Unlock()
+
+	// Give the handlers a moment to clean up after the connections fail.
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
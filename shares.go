@@ -0,0 +1,108 @@
+package main
+
+import "fmt"
+import "os"
+import "path/filepath"
+import "sort"
+
+// A folder that the server makes available to clients, along with what clients
+// may do to it. Clients that don't name a share get the default one, which is
+// the server's root.
+type Share struct {
+	Name string
+	Root string
+	Restrict bool
+	RestrictAll bool
+
+	// Refuse all offers and deletions; clients may only receive files.
+	ReadOnly bool
+
+	// Accept new files, but refuse everything else (including listing the
+	// files that are there).
+	DropBox bool
+
+	// How many versions of replaced or deleted files to keep, and for how
+	// many days (see versions.go).
+	KeepVersions int
+	KeepVersionDays int
+
+	// Metadata extensions that clients may apply to the files they send; the
+	// others in extGuardedMetadata are refused when negotiating.
+	AcceptMetadata Extensions
+}
+
+// The named shares, sorted by name.
+func (config *Config) shareList() (list []*Share) {
+	names := make([]string, 0, len(config.Shares))
+	for name := range(config.Shares) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range(names) {
+		list = append(list, config.Shares[name])
+	}
+	return
+}
+
+// Finds the share that a client asked for by name.
+func (config *Config) lookupShare(name string) (*Share, bool) {
+	if name == "" {
+		return config.Root, true
+	}
+
+	share, ok := config.Shares[name]
+	return share, ok
+}
+
+// Applies a setting for a share from the config file. Relative roots are
+// resolved against the folder that the file is in.
+func setShareOption(share *Share, configDir, key string, value interface{}) (err error) {
+	switch key {
+	case "root":
+		share.Root, err = configString(key, value)
+		if err == nil && !filepath.IsAbs(share.Root) {
+			share.Root = filepath.Join(configDir, share.Root)
+		}
+	case "restrict":
+		share.Restrict, err = configBool(key, value)
+	case "restrict-all":
+		share.RestrictAll, err = configBool(key, value)
+	case "read-only":
+		share.ReadOnly, err = configBool(key, value)
+	case "drop-box":
+		share.DropBox, err = configBool(key, value)
+	case "keep-versions":
+		share.KeepVersions, err = configCount(key, value)
+	case "keep-days":
+		share.KeepVersionDays, err = configCount(key, value)
+	case "accept-metadata":
+		var names []string
+		names, err = configList(key, value)
+		if err == nil {
+			share.AcceptMetadata, err = parseAcceptedMetadata(names)
+		}
+	default:
+		err = fmt.Errorf("Unknown option %s", key)
+	}
+	return
+}
+
+// Checks that a share has a root, and that it is an existing folder.
+func validateShare(share *Share) error {
+	name := share.Name
+	if name == "" {
+		name = "(default)"
+	}
+
+	if share.Root == "" {
+		return fmt.Errorf("Share %s has no root", name)
+	}
+	if share.ReadOnly && share.DropBox {
+		return fmt.Errorf("Share %s can't be both read-only and a drop box", name)
+	}
+	if info, err := os.Stat(share.Root); err != nil || !info.IsDir() {
+		return fmt.Errorf("Root of share %s (%s) is not an existing folder", name, share.Root)
+	}
+	return nil
+}
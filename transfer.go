@@ -0,0 +1,135 @@
+package main
+
+import "net"
+import "sync"
+
+// Transfer pool used by the client when run with --jobs (-j) greater than 1;
+// nil otherwise.
+var transfers *transferPool
+
+// A set of additional connections to the server, each served by a worker that
+// performs file transfers (requests and offers) handed to it by the main
+// synchronization loop.
+type transferPool struct {
+	jobs chan func(net.Conn)
+	wg sync.WaitGroup
+
+	// Transfers that have been submitted but not completed.
+	inFlight sync.WaitGroup
+
+	// Closed when any worker fails; err holds the first failure.
+	failed chan bool
+	failOnce sync.Once
+	err interface{}
+}
+
+// Opens n connections to the server and starts a worker for each.
+func newTransferPool(connectUri string, n int) *transferPool {
+	pool := &transferPool {
+		jobs: make(chan func(net.Conn)),
+		failed: make(chan bool),
+	}
+
+	// If any connection fails, shut down the workers that were already
+	// started.
+	defer func() {
+		if r := recover(); r != nil {
+			pool.close()
+			panic(r)
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		conn := connect(connectUri)
+		pool.wg.Add(1)
+		go pool.work(conn)
+	}
+
+	return pool
+}
+
+func (pool *transferPool) work(conn net.Conn) {
+	defer pool.wg.Done()
+
+	defer func() {
+		if r := recover(); r != nil {
+			conn.Close()
+			pool.failOnce.Do(func() {
+				pool.err = r
+				close(pool.failed)
+			})
+		}
+	}()
+
+	for job := range(pool.jobs) {
+		job(conn)
+	}
+
+	disconnect(conn)
+}
+
+// Hands a transfer to the next idle worker, blocking until one is available.
+// Panics if any worker has failed.
+func (pool *transferPool) submit(job func(net.Conn)) {
+	pool.inFlight.Add(1)
+	run := func(conn net.Conn) {
+		defer pool.inFlight.Done()
+		job(conn)
+	}
+
+	select {
+	case pool.jobs <- run:
+	case <-pool.failed:
+		pool.inFlight.Done()
+		panic(pool.err)
+	}
+}
+
+// Waits for all transfers submitted so far to complete. Panics if any worker
+// has failed.
+func (pool *transferPool) flush() {
+	pool.inFlight.Wait()
+
+	select {
+	case <-pool.failed:
+		panic(pool.err)
+	default:
+	}
+}
+
+// Waits for all outstanding transfers to finish and shuts down the workers.
+// Returns the first failure of any worker, if there was one.
+func (pool *transferPool) close() interface{} {
+	close(pool.jobs)
+	pool.wg.Wait()
+
+	select {
+	case <-pool.failed:
+		return pool.err
+	default:
+		return nil
+	}
+}
+
+// Runs a transfer on the transfer pool, if there is one, or directly on the
+// main connection otherwise. Either way, the transfer counts towards the
+// current step of the synchronization.
+func transfer(conn net.Conn, do func(net.Conn)) {
+	if transfers == nil {
+		do(conn)
+		return
+	}
+
+	done := syncProgress.hold()
+	transfers.submit(func(conn net.Conn) {
+		do(conn)
+		done()
+	})
+}
+
+// Waits for any transfers in progress on the transfer pool to complete.
+func flushTransfers() {
+	if transfers != nil {
+		transfers.flush()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import "os"
+import "path/filepath"
+import "time"
+
+// Where deleted files are moved to, under the root. Each deletion goes into a
+// folder named for the time it was made, under the same relative path that the
+// file had.
+var trashDir = filepath.Join(metaDir, "trash")
+
+// Moves whatever is at path (relative to root) into the trash. Like
+// os.RemoveAll, does nothing if there is nothing at the path (such as when a
+// folder containing it was already trashed).
+func moveToTrash(root, path string) error {
+	if _, err := os.Lstat(filepath.Join(root, path)); os.IsNotExist(err) {
+		return nil
+	}
+
+	batch := time.Now().UTC().Format(versionFormat)
+	trashed := filepath.Join(root, trashDir, batch, path)
+
+	err := os.MkdirAll(filepath.Dir(trashed), os.ModeDir | 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(filepath.Join(root, path), trashed)
+}
+
+// Permanently removes anything that has been in the trash for longer than the
+// configured number of days.
+func purgeTrash(root string) {
+	if trashDays <= 0 {
+		return
+	}
+
+	dir, err := os.Open(filepath.Join(root, trashDir))
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	names, _ := dir.Readdirnames(-1)
+	for _, name := range(names) {
+		t, err := time.Parse(versionFormat, name)
+		if err != nil || time.Since(t) <= time.Duration(trashDays) * 24 * time.Hour {
+			continue
+		}
+
+		logVerbose("Emptying trash from", t.Local().Format(time.RFC3339))
+		if err := os.RemoveAll(filepath.Join(root, trashDir, name)); err != nil {
+			logWarning(err)
+		}
+	}
+}
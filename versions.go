@@ -0,0 +1,237 @@
+package main
+
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "time"
+
+// Folder (under the sync root) where Zync keeps its own data. It is never
+// synced, and clients can't touch anything in it.
+const metaDir = ".zync"
+
+// Where versions of replaced or deleted files are kept, under the root. Each
+// version of a path is stored alongside the others as "{path}.~{version}~",
+// where the version is the time it was replaced.
+var versionsDir = filepath.Join(metaDir, "versions")
+
+const versionFormat = "20060102T150405.000000000Z"
+
+// Whether the server keeps versions of the files that clients replace or
+// delete in a share.
+func (share *Share) keepingVersions() bool {
+	return share.KeepVersions > 0 || share.KeepVersionDays > 0
+}
+
+// Whether a path (relative to the root) is one that clients may access: it
+// doesn't lead outside of the root or into Zync's own folder.
+func validPath(path string) bool {
+	parts := splitPath(filepath.Clean(path))
+	return !pathEscapes(path) && (len(parts) == 0 || parts[0] != metaDir)
+}
+
+// Saves whatever is at path (relative to the share's root) into the version
+// store, if the share keeps versions, and prunes old versions of it. Returns
+// whether it did. Unless move is set, files are linked rather than moved, so
+// that they stay in place until they are replaced; anything else is always
+// moved.
+func saveVersion(share *Share, path string, move bool) bool {
+	if !share.keepingVersions() {
+		return false
+	}
+
+	root := share.Root
+	abs := filepath.Join(root, path)
+	info, err := os.Lstat(abs)
+	if err != nil {
+		return false
+	}
+
+	version := time.Now().UTC().Format(versionFormat)
+	stored := versionPath(root, path, version)
+	checkError(os.MkdirAll(filepath.Dir(stored), os.ModeDir | 0700))
+
+	if move || !info.Mode().IsRegular() {
+		err = os.Rename(abs, stored)
+	} else if err = os.Link(abs, stored); err != nil {
+		err = copyFile(abs, stored)
+	}
+	checkError(err)
+
+	logVerbose("Saved version", version, "of", path)
+	pruneVersions(share, path)
+	return true
+}
+
+// Lists the versions kept for a path, oldest first.
+func listVersions(root, path string) (versions []string) {
+	stored := filepath.Join(root, versionsDir, path)
+	prefix := filepath.Base(stored) + ".~"
+
+	dir, err := os.Open(filepath.Dir(stored))
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	names, _ := dir.Readdirnames(-1)
+	for _, name := range(names) {
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, "~") {
+			versions = append(versions, name[len(prefix):len(name) - 1])
+		}
+	}
+
+	sort.Strings(versions)
+	return
+}
+
+// Whether a version, as given by a client, is one that saveVersion could have
+// made: a timestamp, with nothing in it that could lead elsewhere.
+func validVersion(version string) bool {
+	if strings.ContainsAny(version, "/\\") {
+		return false
+	}
+	_, err := time.Parse(versionFormat, version)
+	return err == nil
+}
+
+// The location of a stored version of a path.
+func versionPath(root, path, version string) string {
+	return filepath.Join(root, versionsDir, fmt.Sprintf("%s.~%s~", path, version))
+}
+
+// Removes versions of a path beyond the share's number to keep, or that are
+// older than its number of days.
+func pruneVersions(share *Share, path string) {
+	root := share.Root
+	versions := listVersions(root, path)
+	keepVersions, keepVersionDays := share.KeepVersions, share.KeepVersionDays
+
+	for i, version := range(versions) {
+		expired := false
+		if keepVersions > 0 && len(versions) - i > keepVersions {
+			expired = true
+		}
+		if keepVersionDays > 0 {
+			t, err := time.Parse(versionFormat, version)
+			if err == nil && time.Since(t) > time.Duration(keepVersionDays) * 24 * time.Hour {
+				expired = true
+			}
+		}
+
+		if expired {
+			logVerbose("Removing version", version, "of", path)
+			if err := os.RemoveAll(versionPath(root, path, version)); err != nil {
+				logWarning(err)
+			}
+		}
+	}
+}
+
+// Prunes the versions of every path in a share's version store.
+func pruneAllVersions(share *Share) {
+	store := filepath.Join(share.Root, versionsDir)
+	pruned := make(map[string]bool)
+
+	filepath.Walk(store, func(abs string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		name := info.Name()
+		i := strings.LastIndex(name, ".~")
+		if i < 0 || !strings.HasSuffix(name, "~") {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(store, filepath.Join(filepath.Dir(abs), name[:i]))
+		if !pruned[rel] {
+			pruned[rel] = true
+			pruneVersions(share, rel)
+		}
+
+		// Folder versions are pruned as a whole.
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// Puts a stored version of a path back in place, saving whatever is there now
+// as a new version first. Files stay in the version store; folders are moved
+// out of it.
+func restoreVersion(share *Share, path, version string) error {
+	root := share.Root
+	stored := versionPath(root, path, version)
+	if !validVersion(version) {
+		return fmt.Errorf("Invalid version %s", version)
+	} else if rel, err := filepath.Rel(filepath.Join(root, versionsDir), stored); err != nil || pathEscapes(rel) {
+		return fmt.Errorf("Invalid version %s of %s", version, path)
+	}
+
+	info, err := os.Lstat(stored)
+	if err != nil {
+		return err
+	}
+
+	abs := filepath.Join(root, path)
+	if _, err := os.Lstat(abs); err == nil {
+		if !saveVersion(share, path, true) {
+			return fmt.Errorf("Cannot restore %s; versions are not being kept.", path)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(abs), os.ModeDir | 0755)
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return os.Rename(stored, abs)
+	}
+
+	temp := tempName(abs)
+	if err = os.Link(stored, temp); err != nil {
+		err = copyFile(stored, temp)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp, abs)
+}
+
+// Copies a regular file, along with its permissions and modification time.
+func copyFile(from, to string) error {
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_WRONLY | os.O_CREATE | os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+
+	return os.Chtimes(to, info.ModTime(), info.ModTime())
+}
@@ -1,12 +1,17 @@
 package main
 
+import "bufio"
+import "encoding/json"
 import "fmt"
 import "io"
 import "io/ioutil"
+import "net"
+import "net/http"
 import "os"
 import "os/exec"
 import "path/filepath"
 import "strings"
+import "syscall"
 import "testing"
 import "time"
 
@@ -30,6 +35,33 @@ func (pw prefixWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// Wraps an io.Writer, stopping once the specified number of bytes have been
+// written until resume is closed. Closes paused when it stops.
+type pausingWriter struct {
+	out io.Writer
+	left int
+	paused chan bool
+	resume chan bool
+}
+
+func (pw *pausingWriter) Write(p []byte) (n int, err error) {
+	if pw.left < 0 || len(p) <= pw.left {
+		pw.left -= len(p)
+		return pw.out.Write(p)
+	}
+
+	n, err = pw.out.Write(p[:pw.left])
+	if err != nil {
+		return
+	}
+	pw.left = -1
+	close(pw.paused)
+	<-pw.resume
+
+	m, err := pw.out.Write(p[n:])
+	return n + m, err
+}
+
 func createTempDir() string {
 	name, err := ioutil.TempDir("", "zync")
 	if err != nil {
@@ -62,43 +94,114 @@ func createTestFile(dir string, name string, content string) (fname string) {
 	return filepath.Base(f.Name())
 }
 
-// Executes zync with the specified arguments in a new temporary directory.
-// Returns the temp folder and a channel that can be closed to kill the process
-// and clean up the temp folder.
+// Closed once the last server started by zyncServe has exited, so that the
+// next one can listen on the same port.
+var serverExited = make(chan bool)
+func init() { close(serverExited) }
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	<-serverExited
+	os.Exit(code)
+}
+
+// Executes zync with the specified arguments, rooted at a new temporary
+// directory, and waits for it to start serving. Returns the temp folder and a
+// channel that can be closed to kill the process and clean up the temp folder.
 func zyncExecAsync(args ...string) (dir string, sig chan bool) {
 	dir = createTempDir()
+	_, _, sig = zyncServe(dir, true, args...)
+	return
+}
+
+// Executes zync with the specified arguments, rooted at the specified
+// directory, and waits for it to start serving. Returns the process, a channel
+// that is closed once it exits, and a channel that can be closed to kill it
+// (if it hasn't exited) and then remove the directory if cleanup is set.
+func zyncServe(dir string, cleanup bool, args ...string) (cmd *exec.Cmd, exited, sig chan bool) {
+	<-serverExited
+	stopped := make(chan bool)
+	serverExited = stopped
 
 	zync := filepath.Join(zyncDir, "zync")
-	cmd := exec.Command(zync, args...)
-	cmd.Dir = dir
-	cmd.Stdout = prefixWriter { os.Stdout, "SERVER (OUT)" }
+	cmd = exec.Command(zync, append(args, "--root", dir)...)
 	cmd.Stderr = prefixWriter { os.Stderr, "SERVER (ERR)" }
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		panic(err)
+	}
 
-	err := cmd.Start()
+	err = cmd.Start()
 	if err != nil {
 		panic(err)
 	}
 
-	sig = make(chan bool)
+	// The server logs that it has started to stdout, or to its log file.
+	started := make(chan bool, 1)
+	const startedMsg = "Zync server started"
+	exited = make(chan bool)
 	go func() {
-		for _ = range(sig) {}
+		defer close(exited)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			fmt.Fprintln(os.Stdout, "SERVER (OUT)", scanner.Text())
+			if strings.Contains(scanner.Text(), startedMsg) {
+				started <- true
+			}
+		}
+		cmd.Wait()
+	}()
 
-		err = cmd.Process.Kill()
-		if err != nil {
-			panic(err)
+	stop := func() {
+		cmd.Process.Kill()
+		<-exited
+
+		if cleanup {
+			os.RemoveAll(dir)
 		}
+		close(stopped)
+	}
 
-		os.RemoveAll(dir)
+	logFile := ""
+	for i, arg := range(args) {
+		if arg == "--log-file" && i + 1 < len(args) {
+			logFile = args[i + 1]
+		}
+	}
+
+	deadline := time.After(10 * time.Second)
+	for ready := false; !ready; {
+		select {
+		case <-started:
+			ready = true
+		case <-exited:
+			stop()
+			panic(fmt.Errorf("zync %s exited before it started serving.", strings.Join(args, " ")))
+		case <-deadline:
+			stop()
+			panic(fmt.Errorf("zync %s didn't start serving.", strings.Join(args, " ")))
+		case <-time.After(10 * time.Millisecond):
+			if logFile != "" {
+				data, _ := ioutil.ReadFile(logFile)
+				ready = strings.Contains(string(data), startedMsg)
+			}
+		}
+	}
+
+	sig = make(chan bool)
+	go func() {
+		for _ = range(sig) {}
+		stop()
 	}()
 
 	return
 }
 
-// Executes zync with the specified arguments in the specified directory.
+// Executes zync with the specified arguments, rooted at the specified
+// directory.
 func zyncExec(dir string, args ...string) {
 	zync := filepath.Join(zyncDir, "zync")
-	cmd := exec.Command(zync, args...)
-	cmd.Dir = dir
+	cmd := exec.Command(zync, append(args, "--root", dir)...)
 	cmd.Stdout = prefixWriter { os.Stdout, "CLIENT (OUT)" }
 	cmd.Stderr = prefixWriter { os.Stderr, "CLIENT (ERR)" }
 
@@ -171,6 +274,64 @@ func expectNotExists(t *testing.T, dir, fname string) {
 	}
 }
 
+// Checks that the specified file has the specified permission bits.
+func expectMode(t *testing.T, dir, fname string, mode os.FileMode) {
+	info, err := os.Stat(filepath.Join(dir, fname))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if info.Mode().Perm() != mode {
+		t.Errorf("Expected %s to have mode %v, has %v.", fname, mode, info.Mode().Perm())
+	}
+}
+
+// Checks that the specified file has the specified modification time.
+func expectModTime(t *testing.T, dir, fname string, modTime time.Time) {
+	info, err := os.Stat(filepath.Join(dir, fname))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("Expected %s to have been modified at %v, was at %v.", fname, modTime, info.ModTime())
+	}
+}
+
+// Checks that the specified file is a symbolic link to the specified target.
+func expectLink(t *testing.T, dir, fname, target string) {
+	actual, err := os.Readlink(filepath.Join(dir, fname))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if actual != target {
+		t.Errorf("Expected %s to link to %s, links to %s.", fname, target, actual)
+	}
+}
+
+// Checks that the two specified files are hard links to the same file.
+func expectSameFile(t *testing.T, dir, fname1, fname2 string) {
+	info1, err := os.Stat(filepath.Join(dir, fname1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	info2, err := os.Stat(filepath.Join(dir, fname2))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !os.SameFile(info1, info2) {
+		t.Errorf("Expected %s and %s to be the same file.", fname1, fname2)
+	}
+}
+
 // The client should send any files the server is missing to it.
 func TestSendingFileToServer(t *testing.T) {
 	svrDir, svr := zyncExecAsync("-s", "-v")
@@ -283,7 +444,7 @@ func TestDeletingFileFromServer(t *testing.T) {
 		fname := createTestFile(svrDir, "", "TestDeletingFileFromServer")
 		expectExists(t, svrDir, fname)
 
-		zyncExec(dir, "-c", "localhost", "-v", "-k", "mine", "-d")
+		zyncExec(dir, "-c", "localhost", "-v", "-k", "mine", "-d", "--force-delete")
 		expectNotExists(t, svrDir, fname)
 	})
 }
@@ -298,7 +459,7 @@ func TestDeletingFileFromClient(t *testing.T) {
 		fname := createTestFile(dir, "", "TestDeletingFileFromClient")
 		expectExists(t, dir, fname)
 
-		zyncExec(dir, "-c", "localhost", "-v", "-k", "theirs", "-d")
+		zyncExec(dir, "-c", "localhost", "-v", "-k", "theirs", "-d", "--force-delete")
 		expectNotExists(t, dir, fname)
 	})
 }
@@ -355,7 +516,7 @@ func TestDeletingFolderFromServer(t *testing.T) {
 		expectExists(t, dir, "TestFile6")
 
 
-		zyncExec(dir, "-c", "localhost", "-v", "-k", "mine", "-d")
+		zyncExec(dir, "-c", "localhost", "-v", "-k", "mine", "-d", "--force-delete")
 
 
 		expectNotExists(t, svrDir, "TestFolder1")
@@ -433,7 +594,7 @@ func TestDeletingFolderFromClient(t *testing.T) {
 		expectExists(t, svrDir, "TestFile6")
 
 
-		zyncExec(dir, "-c", "localhost", "-v", "-k", "theirs", "-d")
+		zyncExec(dir, "-c", "localhost", "-v", "-k", "theirs", "-d", "--force-delete")
 
 
 		expectNotExists(t, svrDir, "TestFolder1")
@@ -515,3 +676,1151 @@ func TestServerRestrictingAll(t *testing.T) {
 		expectContent(t, dir, "TestFile2", "TestFile2b")
 	})
 }
+
+// If the server is run with the "--read-only" option, it will send its files
+// to clients, but refuse to accept or delete any.
+func TestServerReadOnly(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "--read-only", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createTestFile(svrDir, "TestFile1", "TestFile1")
+		createTestFile(svrDir, "TestFile2", "TestFile2a")
+		createTestFile(dir, "TestFile2", "TestFile2b")
+		createTestFile(dir, "TestFile3", "TestFile3")
+
+		future := time.Now().Add(5 * time.Minute)
+		os.Chtimes(filepath.Join(dir, "TestFile2"), future, future)
+
+		zyncExec(dir, "-c", "localhost", "-v")
+
+		expectContent(t, dir, "TestFile1", "TestFile1")
+		expectContent(t, svrDir, "TestFile2", "TestFile2a")
+		expectNotExists(t, svrDir, "TestFile3")
+
+		os.Remove(filepath.Join(dir, "TestFile1"))
+		zyncExec(dir, "-c", "localhost", "-v", "-k", "mine", "-d")
+
+		expectContent(t, svrDir, "TestFile1", "TestFile1")
+	})
+}
+
+// If the server is run with the "--drop-box" option, it will accept new files
+// from clients, but won't send, list, overwrite or delete any.
+func TestServerDropBox(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "--drop-box", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createTestFile(svrDir, "TestFile1", "TestFile1")
+		createTestFile(svrDir, "TestFile2", "TestFile2a")
+		createTestFile(dir, "TestFile2", "TestFile2b")
+		createTestFile(dir, "TestFile3", "TestFile3")
+
+		future := time.Now().Add(5 * time.Minute)
+		os.Chtimes(filepath.Join(dir, "TestFile2"), future, future)
+
+		zyncExec(dir, "-c", "localhost", "-v", "-k", "mine", "-d")
+
+		expectNotExists(t, dir, "TestFile1")
+		expectContent(t, svrDir, "TestFile1", "TestFile1")
+		expectContent(t, svrDir, "TestFile2", "TestFile2a")
+		expectContent(t, svrDir, "TestFile3", "TestFile3")
+	})
+}
+
+// With "--jobs (-j)", files are transferred over several connections at once;
+// the end result should be the same as a sequential sync.
+func TestParallelTransfers(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createDir(svrDir, "TestFolder1")
+		createDir(dir, "TestFolder2")
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprintf("TestFile%d", i)
+			createTestFile(filepath.Join(svrDir, "TestFolder1"), name, name + "a")
+			createTestFile(filepath.Join(dir, "TestFolder2"), name, name + "b")
+		}
+
+		zyncExec(dir, "-c", "localhost", "-v", "-j", "4")
+
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprintf("TestFile%d", i)
+			expectContent(t, dir, filepath.Join("TestFolder1", name), name + "a")
+			expectContent(t, svrDir, filepath.Join("TestFolder2", name), name + "b")
+		}
+	})
+}
+
+// If the connection is lost partway through a sync, the client reconnects and
+// resumes after the last path that it completed, rather than starting over.
+func TestResumingSync(t *testing.T) {
+	withTempDir(func(svrDir string) {
+		_, _, svr := zyncServe(svrDir, false, "-s", "-v")
+		defer func() { close(svr) }()
+
+		withTempDir(func(dir string) {
+			for i := 1; i <= 4; i++ {
+				name := fmt.Sprintf("TestFile%d", i)
+				createTestFile(dir, name, name)
+			}
+
+			// Run interactively, so that the client waits for an answer
+			// before it sends each file.
+			zync := filepath.Join(zyncDir, "zync")
+			cmd := exec.Command(zync, "-c", "localhost", "-v", "-i", "--retries", "3", "--root", dir)
+			cmd.Stderr = prefixWriter { os.Stderr, "CLIENT (ERR)" }
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			timeout := time.AfterFunc(10 * time.Second, func() { cmd.Process.Kill() })
+			defer timeout.Stop()
+
+			prompts := make(map[string]int)
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				line := scanner.Text()
+				fmt.Fprintln(os.Stdout, "CLIENT (OUT)", line)
+
+				prompt := ""
+				for _, kind := range([]string { "NEW: ", "CONFLICT: " }) {
+					if i := strings.Index(line, kind); i >= 0 {
+						prompt = line[i:]
+					}
+				}
+				if prompt == "" {
+					continue
+				}
+				prompts[prompt]++
+
+				// Once the first two files have been sent, restart the server,
+				// changing one of them meanwhile; starting over would find it.
+				if prompt == "NEW: TestFile3" && prompts[prompt] == 1 {
+					close(svr)
+					_, _, svr = zyncServe(svrDir, false, "-s", "-v")
+					createTestFile(svrDir, "TestFile1", "Changed")
+				}
+
+				fmt.Fprintln(stdin, "g")
+			}
+
+			if err := cmd.Wait(); err != nil {
+				t.Fatal(err)
+			}
+
+			if prompts["NEW: TestFile3"] != 2 {
+				t.Errorf("Expected the sync to be interrupted at TestFile3, found %v.", prompts)
+			}
+			for _, prompt := range([]string { "NEW: TestFile1", "NEW: TestFile2" }) {
+				if prompts[prompt] != 1 {
+					t.Errorf("Expected the resumed sync not to revisit %s, found %v.", prompt, prompts)
+				}
+			}
+			expectContent(t, svrDir, "TestFile1", "Changed")
+			expectContent(t, svrDir, "TestFile3", "TestFile3")
+			expectContent(t, svrDir, "TestFile4", "TestFile4")
+		})
+	})
+}
+
+// On SIGTERM, the server stops accepting connections, lets a transfer that is
+// in progress finish, tells the client that it is shutting down, removes any
+// temp files and exits cleanly.
+func TestShuttingDownGracefully(t *testing.T) {
+	withTempDir(func(svrDir string) {
+		server, exited, svr := zyncServe(svrDir, false, "-s", "-v")
+		defer close(svr)
+
+		withTempDir(func(dir string) {
+			content := strings.Repeat("TestFile1", 100000)
+			createTestFile(dir, "TestFile1", content)
+			createTestFile(svrDir, ".zync-1-TestFile2", "TestFile2")
+
+			conn := connect(withPort("localhost"))
+			defer conn.Close()
+
+			fi, _ := statFile(dir, "TestFile1", extensions, false)
+			checkError(send(conn, FileOffer { Info: fi }))
+			if yes, err := expectBool(conn); err != nil || !yes {
+				t.Fatal("Expected the server to accept TestFile1.", err)
+			}
+
+			// Stop halfway through the file's contents.
+			pw := &pausingWriter { conn, len(content) / 2, make(chan bool), make(chan bool) }
+			sent := make(chan error, 1)
+			go func() {
+				sent <- sendFile(pw, fi, filepath.Join(dir, "TestFile1"), extensions)
+			}()
+			<-pw.paused
+
+			if err := server.Process.Signal(syscall.SIGTERM); err != nil {
+				t.Fatal(err)
+			}
+
+			// Wait for the server to stop accepting connections.
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				other, err := net.Dial("tcp", withPort("localhost"))
+				if err != nil {
+					break
+				}
+				other.Close()
+				if time.Now().After(deadline) {
+					t.Fatal("Expected the server to stop accepting connections.")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			close(pw.resume)
+			if err := <-sent; err != nil {
+				t.Fatal(err)
+			}
+			if _, err := expectBool(conn); err != nil {
+				t.Fatal("Expected the server to finish receiving TestFile1.", err)
+			}
+
+			// The server says so in place of a reply to the next request.
+			if _, err := recvMessageType(conn); err != ErrServerShutdown {
+				t.Error("Expected the server to say that it is shutting down, got", err)
+			}
+
+			select {
+			case <-exited:
+			case <-time.After(10 * time.Second):
+				t.Fatal("Expected the server to exit.")
+			}
+			if !server.ProcessState.Success() {
+				t.Error("Expected the server to exit cleanly, got", server.ProcessState)
+			}
+
+			expectContent(t, svrDir, "TestFile1", content)
+			expectNotExists(t, svrDir, ".zync-1-TestFile2")
+		})
+	})
+}
+
+// The server only applies clients' owners (and setuid/setgid bits) if it
+// accepts them with "--accept-metadata".
+func TestAcceptingMetadata(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Changing owners requires root.")
+	}
+
+	owner := func(dir, name string) int {
+		md, err := readMetadata(filepath.Join(dir, name), ExtOwner | ExtNumericIds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(md.Uid)
+	}
+
+	withTempDir(func(dir string) {
+		createTestFile(dir, "TestFile1", "TestFile1")
+		os.Lchown(filepath.Join(dir, "TestFile1"), 1234, 1234)
+		os.Chmod(filepath.Join(dir, "TestFile1"), 0755 | os.ModeSetuid)
+
+		func() {
+			svrDir, svr := zyncExecAsync("serve", "-v")
+			defer close(svr)
+
+			zyncExec(dir, "sync", "localhost", "--perms", "--owner", "--numeric-ids")
+			if uid := owner(svrDir, "TestFile1"); uid != os.Getuid() {
+				t.Errorf("Expected the server not to apply the owner, got %d.", uid)
+			}
+			if info, err := os.Stat(filepath.Join(svrDir, "TestFile1")); err != nil || info.Mode() & os.ModeSetuid != 0 {
+				t.Error("Expected the server not to apply setuid without the owner.")
+			}
+		}()
+
+		svrDir, svr := zyncExecAsync("serve", "-v", "--accept-metadata", "owner")
+		defer close(svr)
+
+		zyncExec(dir, "sync", "localhost", "--perms", "--owner", "--numeric-ids")
+		if uid := owner(svrDir, "TestFile1"); uid != 1234 {
+			t.Errorf("Expected the server to apply the owner, got %d.", uid)
+		}
+	})
+}
+
+// With "--perms", received files take on the sender's permission bits.
+func TestPreservingMode(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createTestFile(dir, "TestFile1", "TestFile1")
+		createTestFile(svrDir, "TestFile2", "TestFile2")
+		os.Chmod(filepath.Join(dir, "TestFile1"), 0751)
+		os.Chmod(filepath.Join(svrDir, "TestFile2"), 0604)
+
+		zyncExec(dir, "-c", "localhost", "-v", "--perms")
+
+		expectMode(t, svrDir, "TestFile1", 0751)
+		expectMode(t, dir, "TestFile2", 0604)
+	})
+}
+
+// Symbolic links are recreated as links by default, except that the server
+// refuses any that point outside of its root.
+func TestPreservingSymlinks(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createTestFile(dir, "TestFile1", "TestFile1")
+		os.Symlink("TestFile1", filepath.Join(dir, "TestLink1"))
+		os.Symlink(filepath.Join("..", filepath.Base(dir), "TestFile1"), filepath.Join(dir, "TestLink2"))
+		os.Symlink("Missing", filepath.Join(svrDir, "TestLink3"))
+
+		zyncExec(dir, "-c", "localhost", "-v")
+
+		expectContent(t, svrDir, "TestFile1", "TestFile1")
+		expectLink(t, svrDir, "TestLink1", "TestFile1")
+		expectNotExists(t, svrDir, "TestLink2")
+		expectLink(t, dir, "TestLink3", "Missing")
+	})
+
+	// Links can't be made to escape through other links in the folders that
+	// they are in, either.
+	withTempDir(func(dir string) {
+		conn := connect(withPort("localhost"))
+		defer disconnect(conn)
+
+		offerAndSend(conn, dir, FileInfo { Path: "TestLink4", Mode: os.ModeSymlink | 0777, Target: "." })
+		offerAndSend(conn, dir, FileInfo { Path: "TestLink4/TestLink5", Mode: os.ModeSymlink | 0777, Target: ".." })
+
+		expectLink(t, svrDir, "TestLink4", ".")
+		if _, err := os.Lstat(filepath.Join(svrDir, "TestLink5")); err == nil {
+			t.Error("Expected the server to refuse a link that escapes through another.")
+		}
+	})
+}
+
+// With "--links copy", links are followed and their targets copied instead.
+func TestCopyingSymlinks(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createTestFile(dir, "TestFile1", "TestFile1")
+		testFolder1 := createDir(dir, "TestFolder1")
+		createTestFile(testFolder1, "TestFile2", "TestFile2")
+		os.Symlink("TestFile1", filepath.Join(dir, "TestLink1"))
+		os.Symlink("TestFolder1", filepath.Join(dir, "TestLink2"))
+
+		zyncExec(dir, "-c", "localhost", "-v", "--links", "copy")
+
+		expectContent(t, svrDir, "TestLink1", "TestFile1")
+		expectContent(t, svrDir, "TestLink2/TestFile2", "TestFile2")
+	})
+
+	// The server never follows links that lead outside of its root.
+	withTempDir(func(outside string) {
+		createTestFile(outside, "Secret", "Secret")
+		os.Symlink(outside, filepath.Join(svrDir, "TestLink3"))
+		os.Symlink(filepath.Join(outside, "Secret"), filepath.Join(svrDir, "TestLink4"))
+
+		withTempDir(func(dir string) {
+			zyncExec(dir, "sync", "localhost", "--links", "copy")
+			expectNotExists(t, dir, "TestLink3")
+			expectNotExists(t, dir, "TestLink4")
+
+			cmd := exec.Command(filepath.Join(zyncDir, "zync"), "get", "localhost", "TestLink4", "--links", "copy", "--root", dir)
+			if err := cmd.Run(); err == nil {
+				t.Error("Expected reading through a link outside of the root to fail.")
+			}
+			expectNotExists(t, dir, "TestLink4")
+		})
+	})
+}
+
+// With "--hard-links", files with several hard links are recreated as hard
+// links on the receiver.
+func TestPreservingHardLinks(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createTestFile(dir, "TestFile1", "TestFile1")
+		os.Link(filepath.Join(dir, "TestFile1"), filepath.Join(dir, "TestFile2"))
+		createTestFile(svrDir, "TestFile3", "TestFile3")
+		os.Link(filepath.Join(svrDir, "TestFile3"), filepath.Join(svrDir, "TestFile4"))
+
+		zyncExec(dir, "-c", "localhost", "-v", "--hard-links", "-j", "2")
+
+		expectContent(t, svrDir, "TestFile2", "TestFile1")
+		expectSameFile(t, svrDir, "TestFile1", "TestFile2")
+		expectContent(t, dir, "TestFile4", "TestFile3")
+		expectSameFile(t, dir, "TestFile3", "TestFile4")
+	})
+}
+
+// Folders are created with the sender's permissions and modification time,
+// even if they don't allow writing to them.
+func TestPreservingFolderMetadata(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		testFolder1 := createDir(svrDir, "TestFolder1")
+		createTestFile(testFolder1, "TestFile1", "TestFile1")
+		testFolder2 := createDir(dir, "TestFolder2")
+		createTestFile(testFolder2, "TestFile2", "TestFile2")
+
+		past := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+		os.Chmod(testFolder1, 0555)
+		os.Chtimes(testFolder1, past, past)
+		os.Chmod(testFolder2, 0750)
+		os.Chtimes(testFolder2, past, past)
+		defer os.Chmod(testFolder1, 0755)
+		defer os.Chmod(filepath.Join(dir, "TestFolder1"), 0755)
+
+		zyncExec(dir, "-c", "localhost", "-v")
+
+		expectContent(t, dir, "TestFolder1/TestFile1", "TestFile1")
+		expectMode(t, dir, "TestFolder1", 0555)
+		expectModTime(t, dir, "TestFolder1", past)
+		expectContent(t, svrDir, "TestFolder2/TestFile2", "TestFile2")
+		expectMode(t, svrDir, "TestFolder2", 0750)
+		expectModTime(t, svrDir, "TestFolder2", past)
+
+		// Folders that both nodes already have get the sender's mod time
+		// back after files are written into them.
+		later := past.Add(time.Hour)
+		createTestFile(testFolder1, "TestFile3", "TestFile3")
+		os.Chtimes(testFolder1, later, later)
+		createTestFile(testFolder2, "TestFile4", "TestFile4")
+		os.Chtimes(testFolder2, later, later)
+
+		zyncExec(dir, "-c", "localhost", "-v")
+
+		expectContent(t, dir, "TestFolder1/TestFile3", "TestFile3")
+		expectModTime(t, dir, "TestFolder1", later)
+		expectContent(t, svrDir, "TestFolder2/TestFile4", "TestFile4")
+		expectModTime(t, svrDir, "TestFolder2", later)
+	})
+}
+
+// Temp files left behind by an interrupted transfer are cleaned up, and never
+// synced.
+func TestRemovingStaleTempFiles(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createTestFile(dir, ".zync-1234-TestFile1", "TestFile1")
+
+		zyncExec(dir, "-c", "localhost", "-v")
+
+		expectNotExists(t, dir, ".zync-1234-TestFile1")
+		expectNotExists(t, svrDir, ".zync-1234-TestFile1")
+	})
+}
+
+// If the server keeps versions, files that clients replace or delete are kept
+// under .zync/versions, and can be restored.
+func TestKeepingVersions(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "-v", "--keep-versions", "2")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createTestFile(dir, "TestFile1", "TestFile1 (new)")
+		createTestFile(svrDir, "TestFile1", "TestFile1 (old)")
+		createTestFile(svrDir, "TestFile2", "TestFile2")
+
+		future := time.Now().Add(5 * time.Minute)
+		os.Chtimes(filepath.Join(dir, "TestFile1"), future, future)
+
+		zyncExec(dir, "-c", "localhost", "-v", "-k", "mine", "-d")
+		expectContent(t, svrDir, "TestFile1", "TestFile1 (new)")
+		expectNotExists(t, svrDir, "TestFile2")
+		expectNotExists(t, dir, ".zync")
+
+		versions, _ := filepath.Glob(filepath.Join(svrDir, ".zync", "versions", "TestFile*.~*~"))
+		if len(versions) != 2 {
+			t.Errorf("Expected 2 versions, found %d.", len(versions))
+		}
+
+		zyncExec(dir, "-c", "localhost", "-v", "--restore", "TestFile1")
+		zyncExec(dir, "-c", "localhost", "-v", "--restore", "TestFile2")
+		expectContent(t, svrDir, "TestFile1", "TestFile1 (old)")
+		expectContent(t, svrDir, "TestFile2", "TestFile2")
+
+		// Versions that lead out of the version store are refused.
+		withTempDir(func(outside string) {
+			createTestFile(outside, "Stolen~", "Stolen")
+			version := "x" + strings.Repeat("/..", 20) + filepath.Join(outside, "Stolen")
+			cmd := exec.Command(filepath.Join(zyncDir, "zync"), "sync", "localhost", "--restore", "TestFile3", "--version", version, "--root", dir)
+			if err := cmd.Run(); err == nil {
+				t.Error("Expected restoring a version from outside of the version store to fail.")
+			}
+			expectNotExists(t, svrDir, "TestFile3")
+		})
+	})
+}
+
+// Deleted files are moved to the trash on either node, unless --no-trash is
+// specified.
+func TestTrashingDeletedFiles(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createTestFile(svrDir, "TestFile1", "TestFile1")
+		zyncExec(dir, "-c", "localhost", "-v", "-k", "mine", "-d", "--force-delete")
+		expectNotExists(t, svrDir, "TestFile1")
+
+		trashed, _ := filepath.Glob(filepath.Join(svrDir, ".zync", "trash", "*", "TestFile1"))
+		if len(trashed) != 1 {
+			t.Errorf("Expected TestFile1 in the server's trash, found %v.", trashed)
+		}
+
+		createTestFile(dir, "TestFile2", "TestFile2")
+		createTestFile(dir, "TestFile3", "TestFile3")
+		zyncExec(dir, "-c", "localhost", "-v", "-k", "theirs", "-d", "--force-delete", "--no-trash")
+		expectNotExists(t, dir, "TestFile2")
+		expectNotExists(t, dir, ".zync")
+	})
+}
+
+// Synchronizing with "--delete" from an empty folder, or deleting more than
+// the allowed share of the server's files, aborts before anything is deleted.
+func TestAbortingMassDeletion(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "-v")
+	defer close(svr)
+
+	expectFailure := func(dir string, args ...string) {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected zync to fail.")
+			}
+		}()
+		zyncExec(dir, args...)
+	}
+
+	withTempDir(func(dir string) {
+		createTestFile(svrDir, "TestFile1", "TestFile1")
+		createTestFile(svrDir, "TestFile2", "TestFile2")
+		createTestFile(svrDir, "TestFile3", "TestFile3")
+
+		expectFailure(dir, "-c", "localhost", "-v", "-k", "mine", "-d")
+		expectExists(t, svrDir, "TestFile1")
+
+		createTestFile(dir, "TestFile1", "TestFile1")
+		expectFailure(dir, "-c", "localhost", "-v", "-k", "mine", "-d")
+		expectExists(t, svrDir, "TestFile2")
+
+		zyncExec(dir, "-c", "localhost", "-v", "-k", "mine", "-d", "--max-delete-percent", "70")
+		expectNotExists(t, svrDir, "TestFile2")
+		expectNotExists(t, svrDir, "TestFile3")
+	})
+}
+
+// Shares defined in the server's config file are synchronized by naming them
+// as "{host}/{share}", each with its own root and settings.
+func TestServingNamedShares(t *testing.T) {
+	withTempDir(func(sharesDir string) {
+		createDir(sharesDir, "docs")
+		createDir(sharesDir, "pub")
+		createTestFile(sharesDir, "pub/TestFile2", "TestFile2")
+		config := createTestFile(sharesDir, "zync.toml", `
+# Test shares.
+[share.docs]
+root = "docs"
+
+[share.pub]
+root = "pub"
+read-only = true
+`)
+
+		_, svr := zyncExecAsync("-s", "-v", "--config", filepath.Join(sharesDir, config))
+		defer close(svr)
+
+		withTempDir(func(dir string) {
+			createTestFile(dir, "TestFile1", "TestFile1")
+
+			zyncExec(dir, "-c", "localhost/docs", "-v")
+			expectContent(t, sharesDir, "docs/TestFile1", "TestFile1")
+
+			zyncExec(dir, "-c", "localhost/pub", "-v")
+			expectContent(t, dir, "TestFile2", "TestFile2")
+			expectNotExists(t, sharesDir, "pub/TestFile1")
+		})
+	})
+}
+
+// On SIGHUP, the server reads its config file again; new connections get the
+// new settings, while connections that are already open keep the old ones.
+func TestReloadingConfig(t *testing.T) {
+	withTempDir(func(configDir string) {
+		config := filepath.Join(configDir, createTestFile(configDir, "zync.toml", "drop-box = false\n"))
+		svrDir := createTempDir()
+		server, _, svr := zyncServe(svrDir, true, "-s", "-v", "--config", config)
+		defer close(svr)
+
+		createTestFile(svrDir, "TestFile1", "TestFile1")
+
+		open := connect(withPort("localhost"))
+		defer disconnect(open)
+		if _, ok := requestFileInfo(open, "TestFile1"); !ok {
+			t.Fatal("Expected the server to list TestFile1.")
+		}
+
+		createTestFile(configDir, "zync.toml", "drop-box = true\n")
+		if err := server.Process.Signal(syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+
+		// Drop boxes don't list their files.
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			conn := connect(withPort("localhost"))
+			_, ok := requestFileInfo(conn, "TestFile1")
+			disconnect(conn)
+			if !ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Expected new connections to get the new settings.")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if _, ok := requestFileInfo(open, "TestFile1"); !ok {
+			t.Error("Expected the open connection to keep the old settings.")
+		}
+	})
+}
+
+// If the server's config file defines users, clients must log in as one of
+// them.
+func TestAuthenticatingUsers(t *testing.T) {
+	withTempDir(func(configDir string) {
+		config := createTestFile(configDir, "zync.toml", `
+[user.ci]
+token = "s3cret"
+`)
+		token := createTestFile(configDir, "token", "s3cret\n")
+		wrongToken := createTestFile(configDir, "wrong-token", "guess")
+
+		svrDir, svr := zyncExecAsync("-s", "-v", "--config", filepath.Join(configDir, config))
+		defer close(svr)
+
+		withTempDir(func(dir string) {
+			createTestFile(dir, "TestFile1", "TestFile1")
+
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Error("Expected zync to fail with the wrong token.")
+					}
+				}()
+				zyncExec(dir, "-c", "localhost", "-v", "--user", "ci", "--token-file", filepath.Join(configDir, wrongToken))
+			}()
+			expectNotExists(t, svrDir, "TestFile1")
+
+			zyncExec(dir, "-c", "localhost", "-v", "--user", "ci", "--token-file", filepath.Join(configDir, token))
+			expectContent(t, svrDir, "TestFile1", "TestFile1")
+		})
+	})
+}
+
+// Users can be limited to reading, writing or deleting within certain
+// subtrees; files they can't read are left out of what the server lists.
+func TestAccessControl(t *testing.T) {
+	withTempDir(func(configDir string) {
+		config := createTestFile(configDir, "zync.toml", `
+[user.ci]
+token = "s3cret"
+read = ["artifacts"]
+write = ["artifacts"]
+delete = []
+`)
+		token := createTestFile(configDir, "token", "s3cret")
+
+		svrDir, svr := zyncExecAsync("-s", "-v", "--config", filepath.Join(configDir, config))
+		defer close(svr)
+
+		withTempDir(func(dir string) {
+			createTestFile(svrDir, "Secret", "Secret")
+			createDir(svrDir, "artifacts")
+			createTestFile(svrDir, "artifacts/TestFile1", "TestFile1")
+			createTestFile(dir, "TestFile2", "TestFile2")
+			createDir(dir, "artifacts")
+			createTestFile(dir, "artifacts/TestFile3", "TestFile3")
+
+			login := []string { "--user", "ci", "--token-file", filepath.Join(configDir, token) }
+			zyncExec(dir, append([]string { "-c", "localhost", "-v" }, login...)...)
+
+			expectNotExists(t, dir, "Secret")
+			expectContent(t, dir, "artifacts/TestFile1", "TestFile1")
+			expectNotExists(t, svrDir, "TestFile2")
+			expectContent(t, svrDir, "artifacts/TestFile3", "TestFile3")
+
+			os.Remove(filepath.Join(dir, "artifacts/TestFile1"))
+			zyncExec(dir, append([]string { "-c", "localhost", "-v", "-k", "mine", "-d", "--force-delete" }, login...)...)
+
+			expectContent(t, svrDir, "artifacts/TestFile1", "TestFile1")
+			expectContent(t, svrDir, "Secret", "Secret")
+
+			// Links can't be used to write outside of the allowed subtrees.
+			createDir(svrDir, "secret")
+			createDir(dir, "secret")
+			createTestFile(dir, "secret/TestFile4", "TestFile4")
+			os.Symlink(filepath.Join("..", "secret"), filepath.Join(dir, "artifacts", "link"))
+			zyncExec(dir, append([]string { "put", "localhost", "artifacts/link" }, login...)...)
+			expectLink(t, svrDir, "artifacts/link", filepath.Join("..", "secret"))
+
+			cmd := exec.Command(filepath.Join(zyncDir, "zync"), append([]string { "put", "localhost", "artifacts/link/TestFile4", "--root", dir }, login...)...)
+			if err := cmd.Run(); err == nil {
+				t.Error("Expected writing through a link to fail.")
+			}
+			expectNotExists(t, svrDir, "secret/TestFile4")
+
+			// Hard links don't give away the paths of files that can't be
+			// read.
+			os.Link(filepath.Join(svrDir, "Secret"), filepath.Join(svrDir, "artifacts", "TestFile5"))
+			userName, tokenFile, hardLinks = "ci", filepath.Join(configDir, token), true
+			defer func() { userName, tokenFile, hardLinks = "", "", false }()
+
+			conn := connect(withPort("localhost"))
+			defer disconnect(conn)
+			for {
+				fi, ok := requestNextFileInfo(conn)
+				if !ok {
+					t.Error("Expected the server to list artifacts/TestFile5.")
+					break
+				}
+				if fi.Path == filepath.Join("artifacts", "TestFile5") {
+					if fi.LinkTo != "" {
+						t.Errorf("Expected no link to an unreadable file, found %s.", fi.LinkTo)
+					}
+					break
+				}
+			}
+		})
+	})
+}
+
+// With "--audit-log", the server records what clients do as JSON lines.
+func TestAuditLog(t *testing.T) {
+	withTempDir(func(logDir string) {
+		logFile := filepath.Join(logDir, "audit.log")
+		svrDir, svr := zyncExecAsync("-s", "-v", "--audit-log", logFile)
+		defer close(svr)
+
+		withTempDir(func(dir string) {
+			createTestFile(svrDir, "TestFile1", "TestFile1")
+			createTestFile(dir, "TestFile2", "TestFile2")
+
+			zyncExec(dir, "-c", "localhost", "-v")
+
+			data, err := ioutil.ReadFile(logFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			events := make(map[string]bool)
+			for _, line := range(strings.Split(strings.TrimSpace(string(data)), "\n")) {
+				var entry map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Errorf("Invalid audit log entry %s: %s", line, err)
+					continue
+				}
+				event, _ := entry["event"].(string)
+				path, _ := entry["path"].(string)
+				if entry["result"] == "ok" {
+					events[strings.TrimSpace(event + " " + path)] = true
+				}
+			}
+
+			for _, event := range([]string { "connect", "request TestFile1", "offer TestFile2", "receive TestFile2" }) {
+				if !events[event] {
+					t.Errorf("Expected %s in the audit log, found %v.", event, events)
+				}
+			}
+		})
+	})
+}
+
+func TestJSONLogFile(t *testing.T) {
+	withTempDir(func(logDir string) {
+		logFile := filepath.Join(logDir, "server.log")
+		svrDir, svr := zyncExecAsync("-s", "--log-level", "debug", "--log-format", "json", "--log-file", logFile)
+		defer close(svr)
+
+		withTempDir(func(dir string) {
+			createTestFile(svrDir, "TestFile1", "TestFile1")
+
+			zyncExec(dir, "-c", "localhost", "-v")
+
+			data, err := ioutil.ReadFile(logFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sessionMessages := 0
+			for _, line := range(strings.Split(strings.TrimSpace(string(data)), "\n")) {
+				var entry map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Errorf("Invalid log entry %s: %s", line, err)
+					continue
+				}
+				if entry["time"] == nil || entry["level"] == nil || entry["msg"] == nil {
+					t.Errorf("Log entry %s is missing fields.", line)
+				}
+				if entry["session"] != nil {
+					sessionMessages++
+				}
+			}
+
+			if sessionMessages == 0 {
+				t.Errorf("Expected messages tagged with a session, found none in %s.", data)
+			}
+		})
+	})
+}
+
+func TestServingMetrics(t *testing.T) {
+	svrDir, svr := zyncExecAsync("-s", "--metrics", "localhost:20742")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createTestFile(svrDir, "TestFile1", "TestFile1")
+		createTestFile(dir, "TestFile2", "TestFile2")
+
+		zyncExec(dir, "-c", "localhost")
+
+		resp, err := http.Get("http://localhost:20742/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, line := range([]string {
+			`zync_files_transferred_total{direction="sent"} 1`,
+			`zync_files_transferred_total{direction="received"} 1`,
+			"zync_bytes_sent_total 9",
+			"zync_bytes_received_total 9",
+		}) {
+			if !strings.Contains(string(data), line + "\n") {
+				t.Errorf("Expected %s in the metrics, found:\n%s", line, data)
+			}
+		}
+	})
+}
+
+func TestCommandLine(t *testing.T) {
+	zync := filepath.Join(zyncDir, "zync")
+
+	if out, err := exec.Command(zync, "--help").Output(); err != nil {
+		t.Errorf("Expected --help to succeed, got %s.", err)
+	} else if !strings.Contains(string(out), "--connect") {
+		t.Errorf("Expected usage text, found %s.", out)
+	}
+
+	for _, args := range([][]string {
+		{ "-s", "--perms" },
+		{ "-c", "localhost", "--port", "1234" },
+		{ "-s", "--no-such-option" },
+		{ "-c", "localhost", "--jobs=0" },
+		{ "-c", "localhost", "stray" },
+		{ "-s", "-c", "localhost" },
+	}) {
+		if err := exec.Command(zync, args...).Run(); err == nil {
+			t.Errorf("Expected %v to be rejected.", args)
+		}
+	}
+
+	// -r is short for --restrict, which is only for servers.
+	if out, _ := exec.Command(zync, "-c", "localhost", "-r").CombinedOutput(); !strings.Contains(string(out), "server option") {
+		t.Errorf("Expected -r to be rejected as a server option, found %s.", out)
+	}
+
+	cmd := exec.Command(zync, "-c", "localhost")
+	cmd.Env = append(os.Environ(), "ZYNC_JOBS=none")
+	if err := cmd.Run(); err == nil {
+		t.Errorf("Expected an invalid ZYNC_JOBS to be rejected.")
+	}
+
+	// Values given with =, and combined flags.
+	withTempDir(func(dir string) {
+		svrDir, svr := zyncExecAsync("-s", "--keep-versions=1")
+		defer close(svr)
+
+		createTestFile(svrDir, "TestFile1", "TestFile1")
+		zyncExec(dir, "-vk", "theirs", "--connect=localhost")
+		expectContent(t, dir, "TestFile1", "TestFile1")
+	})
+}
+
+func TestCommands(t *testing.T) {
+	svrDir, svr := zyncExecAsync("serve", "-v")
+	defer close(svr)
+
+	// Runs a command, returning what it printed.
+	zyncOutput := func(dir string, args ...string) string {
+		cmd := exec.Command(filepath.Join(zyncDir, "zync"), append(args, "--root", dir)...)
+		cmd.Stderr = prefixWriter { os.Stderr, "CLIENT (ERR)" }
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%v failed: %s", args, err)
+		}
+		return string(out)
+	}
+
+	withTempDir(func(dir string) {
+		createDir(svrDir, "TestFolder")
+		createTestFile(svrDir, filepath.Join("TestFolder", "TestFile1"), "TestFile1")
+		createTestFile(dir, "TestFile2", "TestFile2")
+
+		if out := zyncOutput(dir, "ls", "localhost:TestFolder"); !strings.HasPrefix(out, "TestFolder:\n") ||
+			!strings.HasSuffix(out, " TestFile1\n") {
+			t.Errorf("Unexpected listing %q.", out)
+		}
+
+		out := zyncOutput(dir, "status", "localhost")
+		for _, line := range([]string { "receive  TestFolder/TestFile1", "send     TestFile2" }) {
+			if !strings.Contains(out, line + "\n") {
+				t.Errorf("Expected %s in the status, found %q.", line, out)
+			}
+		}
+		expectNotExists(t, dir, "TestFolder")
+		expectNotExists(t, svrDir, "TestFile2")
+
+		zyncExec(dir, "get", "localhost", filepath.Join("TestFolder", "TestFile1"))
+		expectContent(t, dir, filepath.Join("TestFolder", "TestFile1"), "TestFile1")
+
+		zyncExec(dir, "put", "localhost", "TestFile2")
+		expectContent(t, svrDir, "TestFile2", "TestFile2")
+
+		zyncExec(dir, "sync", "localhost")
+		if out := zyncOutput(dir, "status", "localhost"); !strings.HasSuffix(out, "Up to date.\n") {
+			t.Errorf("Expected nothing to do after syncing, found %q.", out)
+		}
+	})
+}
+
+func TestListingServerFiles(t *testing.T) {
+	svrDir, svr := zyncExecAsync("serve", "-v")
+	defer close(svr)
+
+	zyncOutput := func(args ...string) string {
+		cmd := exec.Command(filepath.Join(zyncDir, "zync"), args...)
+		cmd.Stderr = prefixWriter { os.Stderr, "CLIENT (ERR)" }
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%v failed: %s", args, err)
+		}
+		return string(out)
+	}
+
+	createDir(svrDir, filepath.Join("TestFolder", "TestSubfolder"))
+	createTestFile(svrDir, "TestFile1.txt", "TestFile1")
+	createTestFile(svrDir, filepath.Join("TestFolder", "TestFile2.txt"), "TestFile2")
+	createTestFile(svrDir, filepath.Join("TestFolder", "TestSubfolder", "TestFile3.go"), "TestFile3")
+
+	out := zyncOutput("ls", "localhost")
+	for _, part := range([]string { ".:\n", " TestFile1.txt\n", "\nTestFolder:\n", "\nTestFolder/TestSubfolder:\n", " TestFile3.go\n" }) {
+		if !strings.Contains(out, part) {
+			t.Errorf("Expected %q in the listing, found:\n%s", part, out)
+		}
+	}
+
+	// Only the subtree is enumerated.
+	out = zyncOutput("ls", "localhost:TestFolder/TestSubfolder")
+	if strings.Contains(out, "TestFile2") || !strings.Contains(out, " TestFile3.go\n") {
+		t.Errorf("Expected only the subfolder in the listing, found:\n%s", out)
+	}
+
+	out = zyncOutput("ls", "localhost", "--glob", "*.go", "--json")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	var entry map[string]interface{}
+	if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &entry) != nil ||
+		entry["path"] != "TestFolder/TestSubfolder/TestFile3.go" || entry["size"] != 9.0 {
+		t.Errorf("Expected one JSON entry for TestFile3.go, found:\n%s", out)
+	}
+
+	for _, path := range([]string { "NoSuchFolder", "../" + filepath.Base(svrDir) }) {
+		if err := exec.Command(filepath.Join(zyncDir, "zync"), "ls", "localhost:" + path).Run(); err == nil {
+			t.Errorf("Expected listing %s to fail.", path)
+		}
+	}
+}
+
+func TestSyncingSubtree(t *testing.T) {
+	svrDir, svr := zyncExecAsync("serve", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createDir(svrDir, "TestFolderA")
+		createDir(svrDir, "TestFolderB")
+		createDir(dir, "TestFolderA")
+		createDir(dir, "TestFolderB")
+		createTestFile(svrDir, filepath.Join("TestFolderA", "TestFile1"), "TestFile1")
+		createTestFile(svrDir, filepath.Join("TestFolderB", "TestFile2"), "TestFile2")
+		createTestFile(dir, filepath.Join("TestFolderA", "TestFile3"), "TestFile3")
+		createTestFile(dir, filepath.Join("TestFolderB", "TestFile4"), "TestFile4")
+
+		zyncExec(dir, "sync", "localhost", "--path", "TestFolderA")
+		expectContent(t, dir, filepath.Join("TestFolderA", "TestFile1"), "TestFile1")
+		expectContent(t, svrDir, filepath.Join("TestFolderA", "TestFile3"), "TestFile3")
+		expectNotExists(t, dir, filepath.Join("TestFolderB", "TestFile2"))
+		expectNotExists(t, svrDir, filepath.Join("TestFolderB", "TestFile4"))
+
+		// Deletions stay within the subtree too.
+		os.Remove(filepath.Join(dir, "TestFolderA", "TestFile1"))
+		zyncExec(dir, "sync", "localhost:TestFolderA", "-k", "mine", "-d", "--force-delete")
+		expectNotExists(t, svrDir, filepath.Join("TestFolderA", "TestFile1"))
+		expectContent(t, svrDir, filepath.Join("TestFolderB", "TestFile2"), "TestFile2")
+
+		// A subtree that only one side has yet.
+		createDir(dir, "TestFolderC")
+		createTestFile(dir, filepath.Join("TestFolderC", "TestFile5"), "TestFile5")
+		zyncExec(dir, "sync", "localhost", "--path", "TestFolderC")
+		expectContent(t, svrDir, filepath.Join("TestFolderC", "TestFile5"), "TestFile5")
+		expectNotExists(t, svrDir, filepath.Join("TestFolderB", "TestFile4"))
+
+		for _, path := range([]string { "..", ".zync" }) {
+			cmd := exec.Command(filepath.Join(zyncDir, "zync"), "sync", "localhost", "--path", path, "--root", dir)
+			if err := cmd.Run(); err == nil {
+				t.Errorf("Expected --path %s to be rejected.", path)
+			}
+		}
+	})
+}
+
+func TestSyncingFilesFrom(t *testing.T) {
+	svrDir, svr := zyncExecAsync("serve", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createDir(svrDir, "TestFolderA")
+		createTestFile(svrDir, filepath.Join("TestFolderA", "TestFile1"), "TestFile1")
+		createTestFile(svrDir, "TestFile2", "TestFile2")
+		createTestFile(svrDir, "TestUnlisted1", "TestUnlisted1")
+		createDir(dir, filepath.Join("TestFolderB", "TestFolderC"))
+		createTestFile(dir, filepath.Join("TestFolderB", "TestFolderC", "TestFile3"), "TestFile3")
+		createTestFile(dir, "TestUnlisted2", "TestUnlisted2")
+		createTestFile(dir, "list.txt", "# Changed files\n./TestFolderB/TestFolderC/TestFile3\n\nTestFolderA/TestFile1\nTestFile4\n")
+
+		// Folders that listed files are in are created where needed, but
+		// nothing else that isn't listed is synced.
+		zyncExec(dir, "sync", "localhost", "--files-from", filepath.Join(dir, "list.txt"))
+		expectContent(t, dir, filepath.Join("TestFolderA", "TestFile1"), "TestFile1")
+		expectContent(t, svrDir, filepath.Join("TestFolderB", "TestFolderC", "TestFile3"), "TestFile3")
+		expectNotExists(t, dir, "TestFile2")
+		expectNotExists(t, dir, "TestUnlisted1")
+		expectNotExists(t, svrDir, "TestUnlisted2")
+		expectNotExists(t, svrDir, "list.txt")
+
+		// A listed path that the kept side is missing is deleted, but since
+		// that is every listed path, only with --force-delete.
+		deleteListed := func(args ...string) error {
+			cmd := exec.Command(filepath.Join(zyncDir, "zync"), append([]string { "sync", "localhost", "-k", "mine", "-d", "--files-from", "-", "--root", dir }, args...)...)
+			cmd.Stdin = strings.NewReader("TestFile2\n")
+			return cmd.Run()
+		}
+		if err := deleteListed(); err == nil {
+			t.Error("Expected deleting every listed path to be refused.")
+		}
+		expectContent(t, svrDir, "TestFile2", "TestFile2")
+		if err := deleteListed("--force-delete"); err != nil {
+			t.Error(err)
+		}
+		expectNotExists(t, svrDir, "TestFile2")
+		expectContent(t, svrDir, "TestUnlisted1", "TestUnlisted1")
+
+		for _, path := range([]string { "..", ".zync/trash" }) {
+			cmd := exec.Command(filepath.Join(zyncDir, "zync"), "sync", "localhost", "--files-from", "-", "--root", dir)
+			cmd.Stdin = strings.NewReader(path + "\n")
+			if err := cmd.Run(); err == nil {
+				t.Errorf("Expected %s to be rejected.", path)
+			}
+		}
+	})
+}
+
+func TestVerifying(t *testing.T) {
+	svrDir, svr := zyncExecAsync("serve", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		verify := func(args ...string) (string, error) {
+			cmd := exec.Command(filepath.Join(zyncDir, "zync"), append([]string { "sync", "localhost", "--verify", "--root", dir }, args...)...)
+			out, err := cmd.Output()
+			return string(out), err
+		}
+
+		createTestFile(dir, "TestFile1", "TestFile1")
+		createTestFile(dir, "TestFile2", "TestFile2")
+		zyncExec(dir, "sync", "localhost")
+		if out, err := verify(); err != nil {
+			t.Errorf("Expected no differences, got %s: %q", err, out)
+		}
+
+		// Same size and mod time, different contents.
+		info, _ := os.Stat(filepath.Join(dir, "TestFile1"))
+		createTestFile(svrDir, "TestFile1", "TestFileX")
+		os.Chtimes(filepath.Join(svrDir, "TestFile1"), info.ModTime(), info.ModTime())
+		if _, err := verify(); err != nil {
+			t.Error("Expected files with the same size and mod time to match.")
+		}
+		out, err := verify("--hash")
+		if err == nil || out != "differs  TestFile1 (contents differ)\n" {
+			t.Errorf("Expected contents to differ, got %q", out)
+		}
+
+		createTestFile(dir, "TestFile3", "TestFile3")
+		createTestFile(svrDir, "TestFile4", "TestFile4")
+		out, err = verify()
+		if err == nil || out != "missing  TestFile3 (not on the server)\nextra    TestFile4 (only on the server)\n" {
+			t.Errorf("Expected missing and extra files, got %q", out)
+		}
+		expectNotExists(t, svrDir, "TestFile3")
+		expectNotExists(t, dir, "TestFile4")
+
+		// Like diff, differences exit with 1, and errors with 2.
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+			t.Errorf("Expected differences to exit with 1, got %v.", err)
+		}
+		cmd := exec.Command(filepath.Join(zyncDir, "zync"), "sync", "localhost:1", "--verify", "--root", dir)
+		err = cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 2 {
+			t.Errorf("Expected an unreachable server to exit with 2, got %v.", err)
+		}
+	})
+}
+
+// A file where the other node has a folder is a tree conflict; neither is
+// changed, and the rest of the synchronization carries on.
+func TestTreeConflicts(t *testing.T) {
+	svrDir, svr := zyncExecAsync("serve", "-v")
+	defer close(svr)
+
+	withTempDir(func(dir string) {
+		createTestFile(svrDir, "TestFolder", "TestFolder")
+		createDir(dir, "TestFolder")
+		createTestFile(dir, filepath.Join("TestFolder", "TestFile1"), "TestFile1")
+		createTestFile(dir, "TestFile2", "TestFile2")
+
+		zyncExec(dir, "sync", "localhost", "-k", "mine", "--retries", "0")
+		expectContent(t, svrDir, "TestFolder", "TestFolder")
+		expectContent(t, svrDir, "TestFile2", "TestFile2")
+	})
+}